@@ -3,100 +3,156 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"log/syslog"
 	"strings"
+	"time"
+
+	"github.com/rochacon/bastrd/pkg/user"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/urfave/cli"
 )
 
+// allowedGroupFlag are the AWS IAM groups allowed to SSH
+var allowedGroupFlag = cli.StringSliceFlag{
+	Name:  "allowed-group",
+	Usage: "AWS IAM group allowed to SSH. Can be provided multiple times. (defaults to bastrd)",
+}
+
 var AuthorizedKeys = cli.Command{
 	Name:      "authorized-keys",
 	Usage:     "List AWS IAM user registered SSH public keys.",
-	ArgsUsage: "username",
+	ArgsUsage: "username [fingerprint [key-type]]",
 	Action:    getAuthorizedKeysForUser,
 	Aliases:   []string{"authorized_keys"},
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
+		allowedGroupFlag,
+		directoryFileFlag,
 		cli.StringSliceFlag{
-			Name:  "allowed-group",
-			Usage: "AWS IAM group allowed to SSH. Can be provided multiple times. (defaults to bastrd)",
+			Name:  "key-options",
+			Usage: `OpenSSH authorized_keys options for the keys of a group members as group:options, or of users with a tag as tag:key=value:options, e.g. contractors:restrict,pty or vpn:from="10.0.0.0/8". Can be provided multiple times, the first rule setting an option wins.`,
 		},
-	},
+		cli.BoolFlag{
+			Name:  "key-expiry",
+			Usage: "Add the expiry-time option to the keys of users with the bastrd:expires tag, requires OpenSSH 8.2 or later.",
+		},
+	}, append(append(append(append(iamRoleFlags, iamClientFlags...), keyCacheFlags...), keyPolicyFlags...), selectorFlags...)...),
 }
 
 // getAuthorizedKeysForUser validates user belongs to allowed groups and retrieves its SSH public keys from AWS IAM
 func getAuthorizedKeysForUser(ctx *cli.Context) error {
-	username := ctx.Args().Get(0)
-	if username == "" {
+	sysUsername := ctx.Args().Get(0)
+	if sysUsername == "" {
 		return fmt.Errorf("Username argument is required.")
 	}
-	allowedGroups := ctx.StringSlice("allowed-group")
-	if len(allowedGroups) == 0 {
-		allowedGroups = append(allowedGroups, "bastrd")
+	// never hand out AWS IAM keys for system accounts bastrd didn't create, e.g. a same named ubuntu user
+	managed, err := user.Managed(sysUsername)
+	if err != nil {
+		return fmt.Errorf("Error while checking user %q account: %s", sysUsername, err)
 	}
+	if !managed {
+		return fmt.Errorf("User %q is not managed by bastrd.", sysUsername)
+	}
+	// sshd passes the system username, map it back to the AWS IAM username
+	username := user.IAMUsername(sysUsername)
 
-	awsSession := session.Must(session.NewSession(&aws.Config{}))
-	iamSvc := iam.New(awsSession)
-
-	if !userBelongsToAllowedGroups(iamSvc, username, allowedGroups) {
-		return fmt.Errorf("User %q is not allowed to SSH into this instance, this incident will be reported.", username)
+	selector, err := newSelector(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rules := []*user.KeyOptionsRule{}
+	for _, r := range ctx.StringSlice("key-options") {
+		rule, err := user.ParseKeyOptionsRule(r)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
 	}
 
-	keys, err := getUserSSHPublicKeys(iamSvc, username)
+	entry, err := lookupAuthorizedKeys(ctx, username)
 	if err != nil {
 		return fmt.Errorf("Error while retrieving user SSH public keys for user %q: %s", username, err)
 	}
-	if len(keys) == 0 {
+	if entry == nil || !entry.Allowed(allowedGroups(ctx), selector) {
+		return fmt.Errorf("User %q is not allowed to SSH into this instance, this incident will be reported.", username)
+	}
+	// sshd passes the offered key fingerprint and type with %f and %t
+	if fingerprint := ctx.Args().Get(1); fingerprint != "" {
+		entry.Keys = entry.MatchKeys(fingerprint, ctx.Args().Get(2))
+		if len(entry.Keys) == 0 {
+			auditLog("user %q offered unknown SSH public key %s", username, fingerprint)
+			return fmt.Errorf("Found no SSH public key %s for user %q.", fingerprint, username)
+		}
+		for _, key := range entry.Keys {
+			auditLog("user %q offered SSH public key %q %s", username, key.ID, fingerprint)
+		}
+	}
+	policy := newKeyPolicy(ctx)
+	keys := []*user.SSHPublicKey{}
+	for _, key := range entry.Keys {
+		if err = policy.Check(key, time.Now()); err != nil {
+			auditLog("dropping user %q SSH public key %q: %s", username, key.ID, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	entry.Keys = keys
+	if len(entry.Keys) == 0 {
 		return fmt.Errorf("Found no SSH public keys for user %q.", username)
 	}
-	fmt.Println(strings.Join(keys, "\n"))
+	fmt.Println(strings.Join(entry.AuthorizedKeys(rules, ctx.Bool("key-expiry")), "\n"))
 	return nil
 }
 
-// getUserSSHPublicKeys retrieves AWS IAM user SSH public keys
-func getUserSSHPublicKeys(iamSvc awsIAM, username string) ([]string, error) {
-	keys := []string{}
-	sshKeys, err := iamSvc.ListSSHPublicKeys(&iam.ListSSHPublicKeysInput{
-		UserName: aws.String(username),
-	})
+// allowedGroups returns the AWS IAM groups allowed to SSH, defaults to bastrd
+func allowedGroups(ctx *cli.Context) []string {
+	groups := ctx.StringSlice("allowed-group")
+	if len(groups) == 0 {
+		groups = append(groups, "bastrd")
+	}
+	return groups
+}
+
+// auditLog logs to stderr and to the auth syslog facility, sshd discards
+// AuthorizedKeysCommand stderr unless debugging
+func auditLog(format string, v ...interface{}) {
+	msg := fmt.Sprintf("authorized-keys: "+format, v...)
+	log.Print(msg)
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "bastrd")
 	if err != nil {
-		return keys, err
+		return
 	}
-	for _, key := range sshKeys.SSHPublicKeys {
-		if *key.Status != iam.StatusTypeActive {
-			log.Printf("authorized-keys: skipping key %q, status %q", *key.SSHPublicKeyId, *key.Status)
-			continue
+	defer w.Close()
+	w.Info(msg)
+}
+
+// lookupAuthorizedKeys retrieves the user groups and SSH public keys from the
+// key cache while fresh, from the directory otherwise, falling back to the
+// stale key cache if the directory fails
+func lookupAuthorizedKeys(ctx *cli.Context, username string) (*user.KeyCacheEntry, error) {
+	cache := newKeyCache(ctx)
+	var cached *user.KeyCacheEntry
+	if cache != nil {
+		var err error
+		if cached, err = cache.Get(username); err != nil {
+			log.Printf("authorized-keys: ignoring key cache: %s", err)
 		}
-		k, err := iamSvc.GetSSHPublicKey(&iam.GetSSHPublicKeyInput{
-			Encoding:       aws.String(iam.EncodingTypeSsh),
-			SSHPublicKeyId: key.SSHPublicKeyId,
-			UserName:       aws.String(username),
-		})
-		if err != nil {
-			return keys, err
+		if cache.Fresh(cached, time.Now()) {
+			return cached, nil
 		}
-		keys = append(keys, *k.SSHPublicKey.SSHPublicKeyBody)
 	}
-	return keys, nil
-}
 
-// userBelongsToAllowedGroups checks wether user is a member of SSH allowed groups
-func userBelongsToAllowedGroups(iamSvc awsIAM, username string, allowedGroups []string) bool {
-	userGroups, err := iamSvc.ListGroupsForUser(&iam.ListGroupsForUserInput{
-		UserName: aws.String(username),
-	})
-	if err != nil {
-		log.Println("authorized-keys: iam.ListGroupsForUser returned error:", err)
-		return false
-	}
-	for _, group := range userGroups.Groups {
-		if stringIn(*group.GroupName, allowedGroups) {
-			// log.Printf("authorized-keys: user %q belongs to allowed group %q", username, *group.GroupName)
-			return true
+	dir, err := newDirectory(ctx)
+	if err == nil {
+		var entry *user.KeyCacheEntry
+		if entry, err = user.LookupKeys(dir, username); err == nil {
+			return entry, nil
 		}
 	}
-	return false
+	if cache == nil || !cache.Usable(cached, time.Now()) {
+		return nil, err
+	}
+	log.Printf("authorized-keys: using key cache updated at %s: %s", cached.Updated.Format(time.RFC3339), err)
+	return cached, nil
 }
 
 // stringIn matches if a string exist in a string slice
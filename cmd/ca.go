@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rochacon/bastrd/pkg/auth"
+	"github.com/rochacon/bastrd/pkg/ca"
+	"github.com/rochacon/bastrd/pkg/user"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+var CA = cli.Command{
+	Name:  "ca",
+	Usage: "SSH certificate authority.",
+	Subcommands: []cli.Command{
+		{
+			Name:      "sign",
+			Usage:     "Sign an user SSH public key with a short-lived certificate, for the account sync created for the user. The AWS IAM secret access key followed by the MFA code is read from stdin. Must run as root to read the CA key.",
+			ArgsUsage: "public-key-file",
+			Action:    caSign,
+			Flags: append([]cli.Flag{
+				allowedGroupFlag,
+				cli.StringFlag{
+					Name:   "ca-key",
+					Usage:  "CA private key file, must not be accessible by group or others.",
+					EnvVar: "BASTRD_CA_KEY",
+					Value:  "/etc/bastrd/ca",
+				},
+				directoryFileFlag,
+				reservedUserFlag,
+				cli.StringFlag{
+					Name:  "username",
+					Usage: "AWS IAM username.",
+				},
+				cli.DurationFlag{
+					Name:  "validity",
+					Usage: "Certificates validity.",
+					Value: 8 * time.Hour,
+				},
+			}, append(append(append(iamRoleFlags, iamClientFlags...), keyPolicyFlags...), selectorFlags...)...),
+		},
+	},
+}
+
+var Principals = cli.Command{
+	Name:      "principals",
+	Usage:     "List the SSH certificate principals allowed to login as an user, for sshd AuthorizedPrincipalsCommand.",
+	ArgsUsage: "username",
+	Action:    principalsMain,
+	Flags: append([]cli.Flag{
+		allowedGroupFlag,
+		directoryFileFlag,
+		cli.StringSliceFlag{
+			Name:  "shared-account",
+			Usage: "System account shared by the members of an AWS IAM group as account:group, e.g. ec2-user:admins. Can be provided multiple times.",
+		},
+	}, append(append(append(iamRoleFlags, iamClientFlags...), keyCacheFlags...), selectorFlags...)...),
+}
+
+// caSign verifies the user AWS IAM credentials and MFA, and signs its public key
+func caSign(ctx *cli.Context) error {
+	username := ctx.String("username")
+	if username == "" {
+		return fmt.Errorf("Username flag is required.")
+	}
+	if ctx.Args().Get(0) == "" {
+		return fmt.Errorf("Public key file argument is required.")
+	}
+	content, err := ioutil.ReadFile(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return fmt.Errorf("Invalid public key: %s", err)
+	}
+	if err = newKeyPolicy(ctx).CheckKey(key, time.Time{}, time.Now()); err != nil {
+		return fmt.Errorf("Public key rejected: %s", err)
+	}
+	signer, err := ca.LoadSigner(ctx.String("ca-key"))
+	if err != nil {
+		return err
+	}
+	selector, err := newSelector(ctx, nil)
+	if err != nil {
+		return err
+	}
+	user.ReservedUsernames = ctx.StringSlice("reserved-user")
+	if user.ReservedUIDMin, err = user.ReadUIDMin(user.LoginDefsPath); err != nil {
+		return fmt.Errorf("failed to read UID_MIN: %s", err)
+	}
+
+	secretKey, mfaToken, err := readSecretKeyMFA(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	dir, err := newDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	// credentials are checked on the account holding the user, through the
+	// same assumed role as the directory
+	iamSvc, err := userIAM(dir, username)
+	if err != nil {
+		return fmt.Errorf("Error while retrieving user %q: %s", username, err)
+	}
+	if iamSvc == nil {
+		// static identity files hold no credentials, check them on this account
+		iamSvc = newIAMClient(ctx, session.Must(session.NewSession()))
+	}
+	// validation session credentials last the minimum allowed and are discarded
+	if _, err = auth.NewSessionCredentials(iamSvc, username, secretKey, mfaToken, 15*time.Minute); err != nil {
+		return cli.NewExitError(fmt.Errorf("Invalid credentials: %s", err), 1)
+	}
+
+	entry, err := user.LookupKeys(dir, username)
+	if err != nil {
+		return fmt.Errorf("Error while retrieving user %q: %s", username, err)
+	}
+	if entry == nil || !entry.Allowed(allowedGroups(ctx), selector) {
+		return fmt.Errorf("User %q is not allowed to SSH, this incident will be reported.", username)
+	}
+	sysUsername, err := user.SystemUsername(username, entry.Tags)
+	if err != nil {
+		return err
+	}
+	// only accounts sync created for the user are signed, never reserved
+	// accounts nor accounts taken with the bastrd:username tag
+	if !user.OwnedBy(sysUsername, username) {
+		return fmt.Errorf("User %q has no account %q synced by bastrd, this incident will be reported.", username, sysUsername)
+	}
+	authority := ca.New(signer, ctx.Duration("validity"))
+	cert, err := authority.Sign(key, username, ca.Principals(sysUsername, entry.Groups))
+	if err != nil {
+		return err
+	}
+	log.Printf("Signed certificate serial %d for user %q, key %s, principals %s, valid until %s",
+		cert.Serial, username, ssh.FingerprintSHA256(key), strings.Join(cert.ValidPrincipals, ","),
+		time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	fmt.Print(string(ssh.MarshalAuthorizedKey(cert)))
+	return nil
+}
+
+// principalsMain prints the certificate principals allowed to login as an user,
+// the username itself while allowed to SSH, or the groups sharing the account
+func principalsMain(ctx *cli.Context) error {
+	sysUsername := ctx.Args().Get(0)
+	if sysUsername == "" {
+		return fmt.Errorf("Username argument is required.")
+	}
+	shared := []string{}
+	for _, s := range ctx.StringSlice("shared-account") {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid shared account %q, expected account:group.", s)
+		}
+		if parts[0] == sysUsername {
+			shared = append(shared, ca.GroupPrincipalPrefix+parts[1])
+		}
+	}
+	if len(shared) > 0 {
+		fmt.Println(strings.Join(shared, "\n"))
+		return nil
+	}
+
+	managed, err := user.Managed(sysUsername)
+	if err != nil {
+		return fmt.Errorf("Error while checking user %q account: %s", sysUsername, err)
+	}
+	if !managed {
+		return fmt.Errorf("User %q is not managed by bastrd.", sysUsername)
+	}
+	username := user.IAMUsername(sysUsername)
+	selector, err := newSelector(ctx, nil)
+	if err != nil {
+		return err
+	}
+	entry, err := lookupAuthorizedKeys(ctx, username)
+	if err != nil {
+		return fmt.Errorf("Error while retrieving user %q: %s", username, err)
+	}
+	if entry == nil || !entry.Allowed(allowedGroups(ctx), selector) {
+		return fmt.Errorf("User %q is not allowed to SSH into this instance, this incident will be reported.", username)
+	}
+	fmt.Println(sysUsername)
+	return nil
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rochacon/bastrd/pkg/user"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/urfave/cli"
+)
+
+// directoryFileFlag selects a static identity file instead of AWS IAM
+var directoryFileFlag = cli.StringFlag{
+	Name:   "directory-file",
+	Usage:  "Static YAML or JSON identity file to use instead of AWS IAM.",
+	EnvVar: "BASTRD_DIRECTORY_FILE",
+}
+
+// selectorFlags choose AWS IAM users by path and tags in addition to groups
+var selectorFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "iam-path-prefix",
+		Usage: "AWS IAM path prefix of the selected users, e.g. /engineering/.",
+	},
+	cli.StringSliceFlag{
+		Name:  "iam-tag",
+		Usage: "AWS IAM tag of the selected users as key=value, e.g. team=platform. Can be specified multiple times, users must match all tags.",
+	},
+}
+
+// newSelector returns the AWS IAM users selector configured on the command line, selected users are members of group
+func newSelector(ctx *cli.Context, group *user.Group) (*user.Selector, error) {
+	tags, err := user.ParseTagSelectors(ctx.StringSlice("iam-tag"))
+	if err != nil {
+		return nil, err
+	}
+	return &user.Selector{Group: group, PathPrefix: ctx.String("iam-path-prefix"), Tags: tags}, nil
+}
+
+// iamRoleFlags read AWS IAM from other accounts through assumed roles
+var iamRoleFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "iam-role-arn",
+		Usage: "AWS IAM role to assume for reading users, groups and SSH public keys from another account. Can be specified multiple times to merge several accounts.",
+	},
+	cli.StringFlag{
+		Name:  "iam-external-id",
+		Usage: "External ID for assuming the AWS IAM roles.",
+	},
+	cli.StringFlag{
+		Name:  "iam-conflict-policy",
+		Usage: "Policy for usernames found on several accounts, first uses the first account by --iam-role-arn order, skip ignores them and error fails.",
+		Value: user.ConflictFirst,
+	},
+}
+
+// iamClientFlags limit the rate and concurrency of AWS IAM calls
+var iamClientFlags = []cli.Flag{
+	cli.Float64Flag{
+		Name:  "iam-rate-limit",
+		Usage: "Maximum AWS IAM calls per second, shared by all accounts. Throttled calls are retried with backoff. (0 disables it)",
+		Value: 10,
+	},
+	cli.IntFlag{
+		Name:  "iam-burst",
+		Usage: "Maximum burst of AWS IAM calls over the rate limit.",
+		Value: 20,
+	},
+	cli.IntFlag{
+		Name:  "iam-workers",
+		Usage: "Number of concurrent AWS IAM calls when fetching groups, tags and SSH public keys.",
+		Value: user.DefaultWorkers,
+	},
+}
+
+// iamLimiter is shared by all AWS IAM clients of the process
+var iamLimiter *user.RateLimiter
+
+// newIAMClient returns an AWS IAM client rate limited as configured on the command line
+func newIAMClient(ctx *cli.Context, awsSession *session.Session, configs ...*aws.Config) *user.IAMClient {
+	if iamLimiter == nil {
+		iamLimiter = user.NewRateLimiter(ctx.Float64("iam-rate-limit"), ctx.Int("iam-burst"))
+	}
+	// IAMClient retries calls under the rate limit, the SDK must not retry on its own
+	configs = append(configs, &aws.Config{MaxRetries: aws.Int(0)})
+	client := user.NewIAMClient(iam.New(awsSession, configs...), iamLimiter)
+	client.Observe = observeIAM
+	return client
+}
+
+// newIAMDirectory returns an AWS IAM directory fetching users with the configured concurrency
+func newIAMDirectory(ctx *cli.Context, svc user.IAM) *user.IAMDirectory {
+	dir := user.NewIAMDirectory(svc)
+	if workers := ctx.Int("iam-workers"); workers > 0 {
+		dir.Workers = workers
+	}
+	return dir
+}
+
+// userIAM returns the AWS IAM client of the account holding an user on a
+// directory, nil for directories other than AWS IAM
+func userIAM(dir user.Directory, username string) (user.IAM, error) {
+	if multi, ok := dir.(*user.MultiDirectory); ok {
+		owner, err := multi.Owner(username)
+		if err != nil {
+			return nil, err
+		}
+		if owner == nil {
+			return nil, fmt.Errorf("user %q not found on any AWS account", username)
+		}
+		dir = owner
+	}
+	if iamDir, ok := dir.(*user.IAMDirectory); ok {
+		return iamDir.IAM, nil
+	}
+	return nil, nil
+}
+
+// keyCacheFlags configure the users SSH public keys cache written by sync and read by authorized-keys
+var keyCacheFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "key-cache-dir",
+		Usage: "Directory caching users groups and SSH public keys, must be owned by root. (empty disables it)",
+		Value: user.DefaultKeyCacheDir,
+	},
+	cli.DurationFlag{
+		Name:  "key-cache-ttl",
+		Usage: "How long cached users are used by authorized-keys without calling AWS IAM.",
+		Value: time.Minute,
+	},
+	cli.DurationFlag{
+		Name:  "key-cache-stale-if-error",
+		Usage: "How long after the TTL cached users are still used by authorized-keys when AWS IAM fails.",
+		Value: 24 * time.Hour,
+	},
+}
+
+// newKeyCache returns the key cache configured on the command line, nil if disabled
+func newKeyCache(ctx *cli.Context) *user.KeyCache {
+	dir := ctx.String("key-cache-dir")
+	if dir == "" {
+		return nil
+	}
+	return &user.KeyCache{Dir: dir, StaleIfError: ctx.Duration("key-cache-stale-if-error"), TTL: ctx.Duration("key-cache-ttl")}
+}
+
+// keyPolicyFlags restrict the SSH public keys accepted for login
+var keyPolicyFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "key-algorithm",
+		Usage: "Allowed SSH public key algorithm, e.g. ssh-ed25519. Can be specified multiple times. (defaults to all but ssh-dss)",
+	},
+	cli.IntFlag{
+		Name:  "key-min-rsa-bits",
+		Usage: "Minimum RSA SSH public keys size.",
+		Value: 2048,
+	},
+	cli.DurationFlag{
+		Name:  "key-max-age",
+		Usage: "Maximum SSH public keys age since their upload to AWS IAM, e.g. 8760h. (defaults to disabled)",
+	},
+}
+
+// newKeyPolicy returns the SSH public key policy configured on the command line
+func newKeyPolicy(ctx *cli.Context) *user.KeyPolicy {
+	return &user.KeyPolicy{
+		Algorithms: ctx.StringSlice("key-algorithm"),
+		MaxAge:     ctx.Duration("key-max-age"),
+		MinRSABits: ctx.Int("key-min-rsa-bits"),
+	}
+}
+
+// newDirectory returns the identity source configured on the command line, defaults to AWS IAM
+func newDirectory(ctx *cli.Context) (user.Directory, error) {
+	if path := ctx.String(directoryFileFlag.Name); path != "" {
+		return user.LoadFileDirectory(path)
+	}
+	awsSession := session.Must(session.NewSession(&aws.Config{}))
+	roles := ctx.StringSlice("iam-role-arn")
+	if len(roles) == 0 {
+		return newIAMDirectory(ctx, newIAMClient(ctx, awsSession)), nil
+	}
+	dirs := []user.Directory{}
+	for _, roleARN := range roles {
+		// assumed role credentials are refreshed before expiring
+		creds := stscreds.NewCredentials(awsSession, roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "bastrd"
+			if externalID := ctx.String("iam-external-id"); externalID != "" {
+				p.ExternalID = aws.String(externalID)
+			}
+		})
+		svc := newIAMClient(ctx, awsSession, &aws.Config{Credentials: creds})
+		dirs = append(dirs, newIAMDirectory(ctx, svc))
+	}
+	if len(dirs) == 1 {
+		return dirs[0], nil
+	}
+	return user.NewMultiDirectory(ctx.String("iam-conflict-policy"), dirs...)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"log"
+
+	"github.com/rochacon/bastrd/pkg/events"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/urfave/cli"
+)
+
+// newEventsConsumer returns the AWS IAM events consumer configured on the command line, or nil if disabled
+func newEventsConsumer(ctx *cli.Context) *events.Consumer {
+	queueURL := ctx.String("events-queue")
+	if queueURL == "" {
+		return nil
+	}
+	config := &aws.Config{}
+	if endpoint := ctx.String("events-endpoint"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	awsSession := session.Must(session.NewSession(config))
+	return &events.Consumer{QueueURL: queueURL, SQS: sqs.New(awsSession)}
+}
+
+// consumeEvents resyncs the users affected by AWS IAM events until stop is cancelled
+func (s *syncer) consumeEvents(stop context.Context, consumer *events.Consumer) {
+	log.Printf("Consuming AWS IAM events from %q", consumer.QueueURL)
+	consumer.Run(stop, func(event *events.Event) error {
+		if event.Group != "" && !stringIn(event.Group, groupNames(s.groups)) {
+			return nil
+		}
+		log.Printf("Received %s event, syncing user %q", event.Name, event.Username)
+		return s.syncUser(stop, event.Username)
+	})
+}
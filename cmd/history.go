@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rochacon/bastrd/pkg/user"
+
+	"github.com/urfave/cli"
+)
+
+// syncHistoryCommand queries the sync journal
+var syncHistoryCommand = cli.Command{
+	Name:   "history",
+	Usage:  "Print the users changes applied by sync.",
+	Action: syncHistoryMain,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "action",
+			Usage: "Only print changes of the given action, create, modify or remove.",
+		},
+		cli.StringFlag{
+			Name:  "journal-file",
+			Usage: "Path to the append-only journal of users changes.",
+			Value: user.DefaultJournalPath,
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Output format, text or json.",
+			Value: "text",
+		},
+		cli.DurationFlag{
+			Name:  "since",
+			Usage: "Only print changes newer than the given duration, e.g. 24h.",
+		},
+		cli.StringFlag{
+			Name:  "user",
+			Usage: "Only print changes of the given system or AWS IAM username.",
+		},
+	},
+}
+
+// syncHistoryMain prints the journal entries matching the command line filters
+func syncHistoryMain(ctx *cli.Context) error {
+	output := ctx.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("Invalid output format %q, must be text or json.", output)
+	}
+	action := ctx.String("action")
+	username := ctx.String("user")
+	since := time.Time{}
+	if d := ctx.Duration("since"); d > 0 {
+		since = time.Now().Add(-d)
+	}
+	journal := &user.Journal{Path: ctx.String("journal-file")}
+	entries, err := journal.Read(func(e *user.JournalEntry) bool {
+		if action != "" && e.Action != action {
+			return false
+		}
+		if username != "" && e.Username != username && e.IAMUsername != username {
+			return false
+		}
+		return !e.Time.Before(since)
+	})
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if err = enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Println(e)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	iamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastrd_iam_api_errors_total",
+		Help: "AWS IAM API call errors by operation.",
+	}, []string{"operation"})
+	syncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bastrd_sync_duration_seconds",
+		Help:    "Duration of sync loops.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	syncLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastrd_sync_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful sync.",
+	})
+	syncNoncompliantKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastrd_sync_noncompliant_keys",
+		Help: "Number of synced users SSH public keys failing the key policy on the last key cache refresh.",
+	})
+	syncManagedUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastrd_sync_managed_users",
+		Help: "Number of users managed by sync on the system.",
+	})
+	syncUsers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastrd_sync_users_total",
+		Help: "Users changes by result, created, removed or failed.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(iamErrors, syncDuration, syncLastSuccess, syncManagedUsers, syncNoncompliantKeys, syncUsers)
+}
+
+// syncHealth tracks sync loops successes for the health check
+type syncHealth struct {
+	interval     time.Duration
+	lastSuccess  time.Time
+	maxIntervals int
+	mutex        sync.RWMutex
+	started      time.Time
+}
+
+// success records a successful sync
+func (h *syncHealth) success(t time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastSuccess = t
+	syncLastSuccess.Set(float64(t.Unix()))
+}
+
+// ServeHTTP fails when the last successful sync, or the start when there
+// was none, is older than the allowed number of intervals
+func (h *syncHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	last := h.lastSuccess
+	h.mutex.RUnlock()
+	if last.IsZero() {
+		last = h.started
+	}
+	maxAge := h.interval * time.Duration(h.maxIntervals)
+	if age := time.Since(last); age > maxAge {
+		http.Error(w, fmt.Sprintf("last successful sync %s ago", age.Truncate(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// serveMetrics starts the metrics and health check HTTP server
+func serveMetrics(addr string, health http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health)
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Println("Metrics listening on", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server failed: %s", err)
+		}
+	}()
+	return srv
+}
+
+// observeIAM counts AWS IAM API errors by operation
+func observeIAM(operation string, err error) {
+	if err != nil {
+		iamErrors.WithLabelValues(operation).Inc()
+	}
+}
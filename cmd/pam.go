@@ -14,6 +14,9 @@ import (
 	"github.com/rochacon/bastrd/pkg/auth"
 	"github.com/rochacon/bastrd/pkg/user"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/urfave/cli"
 )
@@ -30,7 +33,7 @@ var PAM = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "username",
-			Usage:  "AWS IAM username.",
+			Usage:  "System username, mapped back to its AWS IAM username.",
 			EnvVar: "PAM_USER",
 		},
 		cli.BoolFlag{
@@ -46,17 +49,13 @@ func pamMain(ctx *cli.Context) error {
 	if username == "" {
 		return fmt.Errorf("Username argument (PAM_USER environment variable) is required.")
 	}
-	reader := bufio.NewReader(os.Stdin)
-	secretKey, _ := reader.ReadString('\n')
-	secretKey = strings.TrimSpace(secretKey)
-	secretKey = strings.Trim(secretKey, "\x00")
-	lenSecretKey := len(secretKey)
-	if secretKey == "" || lenSecretKey < 6 {
-		return cli.NewExitError(fmt.Errorf("Secret Key + MFA core is required."), 1)
+	secretKey, mfaToken, err := readSecretKeyMFA(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return cli.NewExitError(err, 1)
 	}
-	secretKey, mfaToken := secretKey[:lenSecretKey-6], secretKey[lenSecretKey-6:]
 	// validation session credentials last only 10s and are discarted
-	creds, err := auth.NewSessionCredentials(username, secretKey, mfaToken, ctx.Duration("duration"))
+	iamSvc := user.NewIAMClient(iam.New(session.Must(session.NewSession()), &aws.Config{MaxRetries: aws.Int(0)}), nil)
+	creds, err := auth.NewSessionCredentials(iamSvc, user.IAMUsername(username), secretKey, mfaToken, ctx.Duration("duration"))
 	if err != nil {
 		return cli.NewExitError(fmt.Errorf("Invalid credentials: %s", err), 1)
 	}
@@ -78,15 +77,31 @@ func pamMain(ctx *cli.Context) error {
 	return nil
 }
 
+// readSecretKeyMFA reads an AWS IAM secret access key immediately followed by a 6 digits MFA code
+func readSecretKeyMFA(reader *bufio.Reader) (string, string, error) {
+	secretKey, _ := reader.ReadString('\n')
+	secretKey = strings.TrimSpace(secretKey)
+	secretKey = strings.Trim(secretKey, "\x00")
+	lenSecretKey := len(secretKey)
+	if secretKey == "" || lenSecretKey < 6 {
+		return "", "", fmt.Errorf("Secret Key + MFA core is required.")
+	}
+	return secretKey[:lenSecretKey-6], secretKey[lenSecretKey-6:], nil
+}
+
 // renderUserSessionCredentials renders the awsCredentials template as
 // /home/username/.aws/credentials file inside the toolbox
 func renderUserSessionCredentials(usr *user.User, token *sts.Credentials) error {
+	uid, err := usr.Uid()
+	if err != nil {
+		return err
+	}
 	homeAWS := filepath.Join(usr.HomeDir(), ".aws")
-	err := os.MkdirAll(homeAWS, 0700)
+	err = os.MkdirAll(homeAWS, 0700)
 	if err != nil {
 		return err
 	}
-	err = os.Chown(homeAWS, int(usr.Uid()), int(usr.Uid()))
+	err = os.Chown(homeAWS, int(uid), int(uid))
 	if err != nil {
 		return err
 	}
@@ -107,7 +122,7 @@ func renderUserSessionCredentials(usr *user.User, token *sts.Credentials) error
 		return err
 	}
 	defer fp.Close()
-	err = os.Chown(filename, int(usr.Uid()), int(usr.Uid()))
+	err = os.Chown(filename, int(uid), int(uid))
 	if err != nil {
 		return err
 	}
@@ -9,7 +9,6 @@ import (
 	"github.com/rochacon/bastrd/pkg/proxy"
 
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/urfave/cli"
 )
 
@@ -17,7 +16,7 @@ var Proxy = cli.Command{
 	Name:   "proxy",
 	Usage:  "AWS IAM authenticated HTTP proxy.",
 	Action: proxyMain,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringSliceFlag{
 			Name:  "allowed-group",
 			Usage: "AWS IAM group allowed to access upstream. Can be provided multiple times. (defaults to empty, which allows all)",
@@ -27,6 +26,7 @@ var Proxy = cli.Command{
 			Usage: "Duration of the allowed group cache.",
 			Value: 5 * time.Minute,
 		},
+		directoryFileFlag,
 		cli.StringFlag{
 			Name:   "bind",
 			Usage:  "Address to listen for HTTP requests.",
@@ -49,7 +49,7 @@ var Proxy = cli.Command{
 			Usage:  "Upstream URL, may include path.",
 			EnvVar: "UPSTREAM_URL",
 		},
-	},
+	}, iamClientFlags...),
 }
 
 func proxyMain(ctx *cli.Context) error {
@@ -69,13 +69,18 @@ func proxyMain(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("Could not parse upstream: %s", err)
 	}
+	dir, err := newDirectory(ctx)
+	if err != nil {
+		return err
+	}
 	allowedGroups := ctx.StringSlice("allowed-group")
 	log.Printf("Allowed groups: %+v", allowedGroups)
 	log.Printf("Forwarding requests to: %s", upstream)
 	srv := proxy.New(ctx.String("bind"), []byte(secretKey), upstream)
 	srv.AllowedGroups = allowedGroups
 	srv.GroupCachePeriod = ctx.Duration("group-cache-period")
-	srv.IAM = iam.New(session.New())
+	srv.Directory = dir
+	srv.IAM = newIAMClient(ctx, session.Must(session.NewSession()))
 	srv.SessionCookieName = sessionCookieName
 	return srv.ListenAndServe()
 }
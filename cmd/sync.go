@@ -1,143 +1,1049 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/rochacon/bastrd/pkg/sudoers"
 	"github.com/rochacon/bastrd/pkg/user"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/urfave/cli"
 )
 
 var (
 	defaultAdditionalGroups = cli.StringSlice([]string{"docker"})
+	defaultReservedUsers    = cli.StringSlice(user.ReservedUsernames)
 )
 
-var Sync = cli.Command{
-	Name:    "sync",
-	Usage:   "Sync AWS IAM users.",
-	Action:  syncMain,
-	Aliases: []string{"sync-users", "sync_users"},
-	Flags: []cli.Flag{
+var reservedUserFlag = cli.StringSliceFlag{
+	Name:  "reserved-user",
+	Usage: "System username never synced, in addition to accounts with uids below login.defs UID_MIN. Can be specified multiple times. (Defaults to root, core and ec2-user)",
+	Value: &defaultReservedUsers,
+}
+
+// syncFlags are shared between sync and its subcommands
+func syncFlags() []cli.Flag {
+	return append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "accounts-backend",
+			Usage: "System accounts backend, shadow-utils runs useradd and friends, files edits /etc/passwd, /etc/group and /etc/shadow directly.",
+			Value: "shadow-utils",
+		},
 		cli.StringSliceFlag{
 			Name:  "additional-group",
 			Usage: "System user additional group. Can be specified multiple times. (Defaults to docker)",
 			Value: &defaultAdditionalGroups,
 		},
+		cli.StringSliceFlag{
+			Name:  "allowed-tag-group",
+			Usage: "System group the bastrd:groups AWS IAM user tag may grant, others are ignored. Can be specified multiple times. (defaults to none)",
+		},
 		cli.BoolFlag{
 			Name:  "disable-sandbox",
 			Usage: "Disable users sandboxed sessions.",
 		},
+		directoryFileFlag,
 		cli.StringSliceFlag{
 			Name:  "group",
 			Usage: "AWS IAM group name to be synced. Can be specified multiple times. ATTENTION: Make sure these groups names don't conflict with existent system groups.",
 		},
+		cli.StringFlag{
+			Name:  "home-template-dir",
+			Usage: "Directory of home directory templates, default holds files for every user and groups/<name> for group members. (defaults to disabled)",
+		},
+		cli.StringFlag{
+			Name:   "home-template-region",
+			Usage:  "AWS region available to home directory templates as {{.Region}}.",
+			EnvVar: "AWS_REGION,AWS_DEFAULT_REGION",
+		},
+		cli.BoolFlag{
+			Name:  "home-template-reapply",
+			Usage: "Re-apply home directory templates to existing users, files edited by the users are kept.",
+		},
+		cli.BoolFlag{
+			Name:  "lock-inactive-keys",
+			Usage: "Lock users whose AWS IAM SSH public keys and access keys are all inactive.",
+		},
+		cli.DurationFlag{
+			Name:  "lock-stale-after",
+			Usage: "Lock users that haven't used their AWS IAM password nor access keys for this long, e.g. 2160h. SSH logins don't count, so users only using the bastion are locked too. (defaults to disabled)",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Plan output format for dry runs, text or json.",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "journal-file",
+			Usage: "Path to the append-only journal of users changes.",
+			Value: user.DefaultJournalPath,
+		},
+		cli.DurationFlag{
+			Name:  "removal-grace-period",
+			Usage: "Time removed users stay locked, with their home directory archived, before being deleted.",
+			Value: 72 * time.Hour,
+		},
+		cli.StringFlag{
+			Name:  "removal-archive-dir",
+			Usage: "Directory for the removed users home directory archives.",
+			Value: user.DefaultArchiveDir,
+		},
+		reservedUserFlag,
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "Filesystem root for the files accounts backend.",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "state-file",
+			Usage: "Path to the state file holding users and groups ids allocations.",
+			Value: user.DefaultStatePath,
+		},
+		cli.StringSliceFlag{
+			Name:  "sudo-group",
+			Usage: "Group sudo rule as group:spec, e.g. prod-admins:ALL or ops:NOPASSWD: /usr/bin/systemctl, the group must be synced or an allowed tag group. Can be specified multiple times.",
+		},
+		cli.StringFlag{
+			Name:  "selector-group",
+			Usage: "System group of the users chosen by --iam-path-prefix and --iam-tag.",
+			Value: "bastrd",
+		},
+		cli.StringFlag{
+			Name:  "sudoers-dir",
+			Usage: "Directory for the managed sudoers files.",
+			Value: sudoers.DefaultDir,
+		},
+	}, append(append(append(append(iamRoleFlags, iamClientFlags...), keyCacheFlags...), keyPolicyFlags...), selectorFlags...)...)
+}
+
+var Sync = cli.Command{
+	Name:    "sync",
+	Usage:   "Sync AWS IAM users.",
+	Action:  syncMain,
+	Aliases: []string{"sync-users", "sync_users"},
+	Flags: append(syncFlags(),
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the pending changes and exit without touching the system.",
+		},
+		cli.StringFlag{
+			Name:  "events-endpoint",
+			Usage: "SQS endpoint override, e.g. http://localhost:9324 for a local SQS compatible queue.",
+		},
+		cli.StringFlag{
+			Name:  "events-queue",
+			Usage: "SQS queue URL of AWS IAM CloudTrail events, affected users are synced as events arrive. Polling is kept as fallback.",
+		},
 		cli.DurationFlag{
 			Name:  "interval",
 			Usage: "Time interval between sync loops.",
 		},
+		cli.IntFlag{
+			Name:  "health-max-intervals",
+			Usage: "Number of intervals without a successful sync before /healthz fails.",
+			Value: 3,
+		},
+		cli.StringFlag{
+			Name:  "metrics-bind",
+			Usage: "Address to serve Prometheus /metrics and /healthz, e.g. 127.0.0.1:9100. (defaults to disabled)",
+		},
+		cli.DurationFlag{
+			Name:  "max-backoff",
+			Usage: "Maximum delay between retries of failed sync loops.",
+			Value: 5 * time.Minute,
+		},
+	),
+	Subcommands: []cli.Command{
+		{
+			Name:   "plan",
+			Usage:  "Print the pending changes without touching the system.",
+			Action: syncPlanMain,
+			Flags:  syncFlags(),
+		},
+		syncHistoryCommand,
+		{
+			Name:   "keys",
+			Usage:  "Print the synced users SSH public keys compliance with the key policy.",
+			Action: syncKeysMain,
+			Flags:  syncFlags(),
+		},
 	},
 }
 
+// syncer holds the sync settings
+type syncer struct {
+	additionalGroups   []string
+	allowedTagGroups   []string
+	archiveDir         string
+	directory          user.Directory
+	groups             []*user.Group
+	homeReapply        bool
+	homeTemplate       *user.HomeTemplate
+	journal            *user.Journal
+	keyCache           *user.KeyCache
+	keyPolicy          *user.KeyPolicy
+	lockPolicy         *user.LockPolicy
+	selector           *user.Selector
+	mutex              sync.Mutex
+	output             string
+	removalGracePeriod time.Duration
+	root               string
+	sandboxed          bool
+	statePath          string
+	sudoRules          []*sudoers.Rule
+	sudoers            *sudoers.Manager
+}
+
+// newSyncer parses sync settings from the command line flags
+func newSyncer(ctx *cli.Context) (*syncer, error) {
+	groupNames := ctx.StringSlice("group")
+	output := ctx.String("output")
+	if output != "text" && output != "json" {
+		return nil, fmt.Errorf("Invalid output format %q, must be text or json.", output)
+	}
+	switch ctx.String("accounts-backend") {
+	case "shadow-utils":
+		user.System = &user.ShadowUtils{}
+	case "files":
+		user.System = &user.Files{Root: ctx.String("root")}
+	default:
+		return nil, fmt.Errorf("Invalid accounts backend %q, must be shadow-utils or files.", ctx.String("accounts-backend"))
+	}
+	user.ReservedUsernames = ctx.StringSlice("reserved-user")
+	uidMin, err := user.ReadUIDMin(filepath.Join(ctx.String("root"), user.LoginDefsPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UID_MIN: %s", err)
+	}
+	user.ReservedUIDMin = uidMin
+	user.LoginShells, err = user.ReadShells(filepath.Join(ctx.String("root"), user.ShellsPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read login shells: %s", err)
+	}
+	dir, err := newDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &syncer{
+		additionalGroups:   ctx.StringSlice("additional-group"),
+		allowedTagGroups:   ctx.StringSlice("allowed-tag-group"),
+		archiveDir:         ctx.String("removal-archive-dir"),
+		directory:          dir,
+		groups:             []*user.Group{},
+		homeReapply:        ctx.Bool("home-template-reapply"),
+		journal:            &user.Journal{Path: ctx.String("journal-file")},
+		keyCache:           newKeyCache(ctx),
+		keyPolicy:          newKeyPolicy(ctx),
+		output:             output,
+		removalGracePeriod: ctx.Duration("removal-grace-period"),
+		root:               ctx.String("root"),
+		sandboxed:          ctx.Bool("disable-sandbox") == false,
+		statePath:          ctx.String("state-file"),
+		sudoRules:          []*sudoers.Rule{},
+		sudoers:            &sudoers.Manager{Dir: ctx.String("sudoers-dir")},
+	}
+	for _, name := range groupNames {
+		s.groups = append(s.groups, &user.Group{Name: name})
+	}
+	s.lockPolicy = &user.LockPolicy{
+		InactiveKeys: ctx.Bool("lock-inactive-keys"),
+		StaleAfter:   ctx.Duration("lock-stale-after"),
+	}
+	if dir := ctx.String("home-template-dir"); dir != "" {
+		s.homeTemplate = &user.HomeTemplate{
+			Dir:    dir,
+			Region: ctx.String("home-template-region"),
+			Root:   ctx.String("root"),
+		}
+	}
+	selectorGroup := &user.Group{Name: ctx.String("selector-group")}
+	for _, g := range s.groups {
+		if g.Name == selectorGroup.Name {
+			selectorGroup = g
+		}
+	}
+	s.selector, err = newSelector(ctx, selectorGroup)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.groups) == 0 && s.selector.Empty() {
+		return nil, fmt.Errorf("You must provide at least 1 AWS IAM group name or user selector.")
+	}
+	for _, r := range ctx.StringSlice("sudo-group") {
+		rule, err := sudoers.ParseRule(r)
+		if err != nil {
+			return nil, err
+		}
+		// a typo would grant sudo to a local group bastrd doesn't manage
+		if !groupIn(rule.Group, s.systemGroups()) && !stringIn(rule.Group, s.allowedTagGroups) {
+			return nil, fmt.Errorf("Invalid sudo rule %q, group %q is neither synced nor an allowed tag group.", r, rule.Group)
+		}
+		s.sudoRules = append(s.sudoRules, rule)
+	}
+	return s, nil
+}
+
 func syncMain(ctx *cli.Context) error {
-	groups := ctx.StringSlice("group")
-	if len(groups) == 0 {
-		return fmt.Errorf("You must provide at least 1 AWS IAM group name.")
+	s, err := newSyncer(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("dry-run") {
+		return s.printPlan()
 	}
 	interval := ctx.Duration("interval")
 	if interval.Minutes() == 0.0 && interval.Seconds() == 0.0 {
 		log.Println("Defaulting interval to 1m")
 		interval = time.Second * 60
 	}
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
-	log.Println("Executing initial sync")
-	err := syncGroupsUsers(ctx)
-	if err != nil {
-		log.Printf("initial sync failed: %s", err)
+	maxBackoff := ctx.Duration("max-backoff")
+	health := &syncHealth{
+		interval:     interval,
+		maxIntervals: ctx.Int("health-max-intervals"),
+		started:      time.Now(),
+	}
+	if addr := ctx.String("metrics-bind"); addr != "" {
+		srv := serveMetrics(addr, health)
+		defer srv.Close()
+	}
+
+	// SIGINT and SIGTERM stop the loop in between system changes, SIGHUP triggers a resync
+	stop, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resync := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				log.Println("Received SIGHUP, scheduling resync.")
+				select {
+				case resync <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			log.Printf("Received %s, quitting after the current change.", sig)
+			cancel()
+			return
+		}
+	}()
+
+	// the events consumer may be applying an user change, wait for it to stop too
+	consumers := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		consumers.Wait()
+	}()
+	if consumer := newEventsConsumer(ctx); consumer != nil {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			s.consumeEvents(stop, consumer)
+		}()
 	}
-	log.Printf("Initiating sync loop for groups: %s", strings.Join(groups, ", "))
+
+	log.Printf("Initiating sync loop for groups: %s", strings.Join(groupNames(s.systemGroups()), ", "))
+	failures := 0
 	for {
+		log.Printf("Starting sync")
+		wait := interval
+		started := time.Now()
+		err = s.sync(stop)
+		syncDuration.Observe(time.Since(started).Seconds())
+		if stop.Err() != nil {
+			log.Println("Sync loop stopped.")
+			return nil
+		}
+		if err != nil {
+			failures++
+			wait = backoff(failures, maxBackoff)
+			log.Printf("Sync failed %d time(s) in a row, retrying in %s: %s", failures, wait, err)
+		} else {
+			failures = 0
+			health.success(time.Now())
+			log.Printf("Finished sync")
+		}
 		select {
-		case <-time.After(interval):
-			log.Printf("Starting sync")
-			err = syncGroupsUsers(ctx)
-			if err != nil {
+		case <-time.After(wait):
+		case <-resync:
+		case <-stop.Done():
+			log.Println("Sync loop stopped.")
+			return nil
+		}
+	}
+}
+
+// backoff returns an exponential delay with jitter for the given number of
+// consecutive failures, from 5s up to max
+func backoff(failures int, max time.Duration) time.Duration {
+	delay := 5 * time.Second
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// equal jitter, between half and the full delay
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// syncPlanMain prints the pending sync changes
+func syncPlanMain(ctx *cli.Context) error {
+	s, err := newSyncer(ctx)
+	if err != nil {
+		return err
+	}
+	return s.printPlan()
+}
+
+// syncKeysMain prints the synced users SSH public keys compliance report
+func syncKeysMain(ctx *cli.Context) error {
+	s, err := newSyncer(ctx)
+	if err != nil {
+		return err
+	}
+	return s.printKeys()
+}
+
+// printKeys checks the synced users SSH public keys against the key policy
+// and prints the report in the configured output format
+func (s *syncer) printKeys() error {
+	plan, _, err := s.plan()
+	if err != nil {
+		return err
+	}
+	entries, err := user.LookupAllKeys(s.directory, plan.Keys)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		c := s.keyPolicy.Compliance(entry, time.Now())
+		if s.output == "json" {
+			if err = enc.Encode(c); err != nil {
 				return err
 			}
-			log.Printf("Finished sync")
-		case <-quit:
-			log.Println("Received SIGINT, quitting.")
-			return nil
+			continue
 		}
+		fmt.Println(c)
 	}
+	return nil
 }
 
-// syncGroupsUsers synchronizes users from AWS IAM
-func syncGroupsUsers(ctx *cli.Context) error {
-	additionalGroups := ctx.StringSlice("additional-group")
-	isSandboxed := ctx.Bool("disable-sandbox") == false
-	groupNames := ctx.StringSlice("group")
-	groups := []*user.Group{}
-	for _, name := range groupNames {
-		groups = append(groups, &user.Group{Name: name})
+// printPlan computes the sync plan and prints it in the configured output format
+func (s *syncer) printPlan() error {
+	plan, _, err := s.plan()
+	if err != nil {
+		return err
+	}
+	if s.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	fmt.Print(plan.String())
+	return nil
+}
+
+// plan computes the changes required to synchronize system users with AWS IAM.
+// Ids for groups and new users are allocated on the returned state, which
+// is not persisted.
+func (s *syncer) plan() (*user.Plan, *user.State, error) {
+	iamUsers, err := user.FromDirectorySelector(s.directory, s.selector, s.groups...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve AWS IAM users list: %s", err)
+	}
+	sysUsers, err := user.FromSystemGroups(s.systemGroups()...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve system users list: %s", err)
+	}
+	plan, state, err := s.newPlan(iamUsers, sysUsers)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan.Sudoers, err = s.sudoers.Plan(s.sudoRules)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to plan sudoers changes: %s", err)
+	}
+	// forget pending removals of users deleted out of band
+	for username := range state.Removals {
+		if iamUsers.Get(username) == nil && sysUsers.Get(username) == nil {
+			delete(state.Removals, username)
+		}
+	}
+	return plan, state, nil
+}
+
+// planUser computes the changes required to synchronize the system user of an AWS IAM user
+func (s *syncer) planUser(iamUsername string) (*user.Plan, *user.State, error) {
+	iamUsers, err := user.FromDirectoryUser(s.directory, iamUsername, s.selector, s.groups...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve AWS IAM user %q: %s", iamUsername, err)
+	}
+	sysUsers, err := user.FromSystemGroups(s.systemGroups()...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve system users list: %s", err)
+	}
+	current := user.Users{}
+	for _, u := range sysUsers {
+		if u.IAMUsername == iamUsername || iamUsers.Get(u.Username) != nil {
+			current = append(current, u)
+		}
+	}
+	return s.newPlan(iamUsers, current)
+}
+
+// newPlan computes the changes required to make the system users look like the AWS IAM users
+func (s *syncer) newPlan(iamUsers, sysUsers user.Users) (*user.Plan, *user.State, error) {
+	state, err := user.LoadState(s.statePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, group := range s.systemGroups() {
+		group.GID, err = state.GID(group.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// an AWS IAM user deleted and re-created under the same name is someone
+	// else, the previous account is removed before creating a new one
+	recreated := []string{}
+	desired := user.Users{}
+	for _, u := range iamUsers {
+		record, ok := state.Users[u.Username]
+		if ok && record.IAMUserID != "" && u.IAMUserID != "" && record.IAMUserID != u.IAMUserID && sysUsers.Get(u.Username) != nil {
+			log.Printf("AWS IAM user %q was re-created with UserId %q, previously %q, removing its previous account first", u.IAMUsername, u.IAMUserID, record.IAMUserID)
+			recreated = append(recreated, u.Username)
+			continue
+		}
+		desired = append(desired, u)
+	}
+	iamUsers = desired
+	// users whose lock state couldn't be computed keep their account as is
+	lockUnknown := []string{}
+	iamUsernames := []string{}
+	for _, u := range iamUsers {
+		iamUsernames = append(iamUsernames, u.IAMUsername)
+	}
+	lockReasons, lockErrs := s.lockPolicy.LockReasons(s.directory, iamUsernames, time.Now())
+	for i, u := range iamUsers {
+		u.Shell = u.LoginShell(s.sandboxed)
+		for _, name := range u.TagGroups() {
+			if !stringIn(name, s.allowedTagGroups) && !groupIn(name, s.systemGroups()) && !stringIn(name, s.additionalGroups) {
+				log.Printf("Ignoring user %q %s tag group %q, it isn't an allowed tag group", u.Username, user.TagGroups, name)
+			}
+		}
+		for _, name := range s.tagGroups(u) {
+			u.Groups = append(u.Groups, &user.Group{Name: name})
+		}
+		u.Expires = u.TagExpiration()
+		u.Locked = lockReasons[i]
+		if lockErrs[i] != nil {
+			log.Printf("Skipping user %q account lock changes: %s", u.Username, lockErrs[i])
+			lockUnknown = append(lockUnknown, u.Username)
+		}
+		sysUser := sysUsers.Get(u.Username)
+		if sysUser == nil {
+			continue
+		}
+		// restoring unlocks the account and clears its expiration
+		if state.Removals[u.Username] != nil {
+			sysUser.Expires = time.Time{}
+			sysUser.Locked = ""
+			continue
+		}
+		// accounts locked by operators, not by sync, are kept locked
+		if _, ok := state.Locks[u.Username]; sysUser.Locked != "" && !ok && u.Locked == "" {
+			u.Locked = sysUser.Locked
+		}
+	}
+	// load memberships granted by tags, including previously granted ones, so revoked groups are removed
+	for _, u := range sysUsers {
+		extraGroups := state.ExtraGroups[u.Username]
+		if iamUser := iamUsers.Get(u.Username); iamUser != nil {
+			extraGroups = append(extraGroups, s.tagGroups(iamUser)...)
+		}
+		err = u.AppendSystemGroups(extraGroups...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to retrieve user %q system groups: %s", u.Username, err)
+		}
+	}
+	plan := user.NewPlan(iamUsers, sysUsers)
+	plan.Recreated = recreated
+	accounts := []*user.AccountChange{}
+	for _, c := range plan.Accounts {
+		if !stringIn(c.Username, lockUnknown) {
+			accounts = append(accounts, c)
+		}
+	}
+	plan.Accounts = accounts
+	for _, u := range iamUsers {
+		state.ExtraGroups[u.Username] = s.tagGroups(u)
+		if _, ok := state.Removals[u.Username]; ok {
+			plan.Restore = append(plan.Restore, u)
+		}
+	}
+	err = plan.SkipUnmanaged()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, username := range plan.Unmanaged {
+		log.Printf("Skipping user %q, its account was not created by bastrd", username)
+	}
+	// record the AWS IAM identity of existing managed users
+	for _, u := range iamUsers {
+		if sysUsers.Get(u.Username) == nil || stringIn(u.Username, plan.Unmanaged) {
+			continue
+		}
+		record, ok := state.Users[u.Username]
+		if !ok {
+			record = &user.ManagedUser{Since: time.Now()}
+			state.Users[u.Username] = record
+		}
+		record.Groups = groupNames(u.Groups)
+		record.IAMUsername = u.IAMUsername
+		if u.IAMUserID != "" {
+			record.IAMUserID = u.IAMUserID
+		}
+		if s.homeTemplate != nil && s.homeReapply {
+			plan.Homes = append(plan.Homes, u)
+		}
 	}
+	for _, u := range iamUsers {
+		if !stringIn(u.Username, plan.Unmanaged) {
+			plan.Keys = append(plan.Keys, u.IAMUsername)
+		}
+	}
+	for _, u := range plan.Create {
+		u.UID, err = state.UID(u.Username)
+		if err != nil {
+			log.Printf("Failed to allocate uid for user %q: %s", u.Username, err)
+			continue
+		}
+	}
+	return plan, state, nil
+}
 
-	awsSession := session.Must(session.NewSession(&aws.Config{}))
-	iamSvc := iam.New(awsSession)
+// sync synchronizes users from AWS IAM.
+// Cancelling stop interrupts the sync in between system changes.
+func (s *syncer) sync(stop context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	plan, state, err := s.plan()
+	if err != nil {
+		return err
+	}
+	res, err := s.apply(stop, plan, state)
+	if err != nil {
+		return err
+	}
+	syncManagedUsers.Set(float64(plan.Managed + res.created - res.removed))
+	if stop.Err() != nil {
+		return stop.Err()
+	}
 
-	iamUsers, err := user.FromIAMGroups(iamSvc, groups...)
+	// grant sudo rights to groups
+	err = s.sudoers.Sync(s.sudoRules)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve AWS IAM users list: %s", err)
+		return fmt.Errorf("failed to sync sudoers: %s", err)
+	}
+	if s.keyCache != nil {
+		// removed users entries are pruned even if refreshing others failed,
+		// so they can't be served by the stale if error fallback
+		entries, refreshErr := s.keyCache.Refresh(s.directory, plan.Keys)
+		syncNoncompliantKeys.Set(float64(s.reportKeys(entries)))
+		if err = s.keyCache.Prune(plan.Keys); err != nil {
+			return fmt.Errorf("failed to prune key cache: %s", err)
+		}
+		if refreshErr != nil {
+			return fmt.Errorf("failed to refresh key cache: %s", refreshErr)
+		}
+	}
+	if res.failed > 0 {
+		return fmt.Errorf("%d change(s) failed", res.failed)
 	}
-	sysUsers, err := user.FromSystemGroups(groups...)
+	return nil
+}
+
+// syncUser synchronizes the system user of a single AWS IAM user
+func (s *syncer) syncUser(stop context.Context, iamUsername string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	plan, state, err := s.planUser(iamUsername)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve system users list: %s", err)
+		return err
 	}
+	res, err := s.apply(stop, plan, state)
+	if err != nil {
+		return err
+	}
+	syncManagedUsers.Add(float64(res.created - res.removed))
+	if stop.Err() != nil {
+		return stop.Err()
+	}
+	if s.keyCache != nil {
+		if stringIn(iamUsername, plan.Keys) {
+			var entries []*user.KeyCacheEntry
+			entries, err = s.keyCache.Refresh(s.directory, []string{iamUsername})
+			s.reportKeys(entries)
+		} else {
+			err = s.keyCache.Delete(iamUsername)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update key cache of user %q: %s", iamUsername, err)
+		}
+	}
+	if res.failed > 0 {
+		return fmt.Errorf("%d change(s) failed", res.failed)
+	}
+	return nil
+}
+
+// applyResult counts the users changes applied to the system
+type applyResult struct {
+	created int
+	failed  int
+	removed int
+}
+
+// apply executes a plan, persisting the state before and after touching the system.
+// Cancelling stop interrupts it in between system changes.
+func (s *syncer) apply(stop context.Context, plan *user.Plan, state *user.State) (*applyResult, error) {
+	// persist ids allocations and tag granted groups before touching the system
+	err := state.Save()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save state: %s", err)
+	}
+
+	res := &applyResult{}
+	defer func() {
+		syncUsers.WithLabelValues("created").Add(float64(res.created))
+		syncUsers.WithLabelValues("failed").Add(float64(res.failed))
+		syncUsers.WithLabelValues("removed").Add(float64(res.removed))
+	}()
 
 	// Ensure groups in the system
-	for _, group := range groups {
+	for _, group := range s.systemGroups() {
 		log.Printf("Ensuring group %q", group.Name)
 		err = group.Ensure()
 		if err != nil {
 			log.Printf("Failed to ensure group %q in the system: %s", group.Name, err)
+			res.failed++
 			continue
 		}
 	}
 
 	// create AWS IAM users that do not exist in the system
-	for _, u := range iamUsers.Diff(sysUsers) {
+	for _, u := range plan.Create {
+		if stop.Err() != nil {
+			break
+		}
 		log.Printf("Ensuring user %q", u.Username)
-		err = u.Ensure(isSandboxed, additionalGroups)
+		err = u.Ensure(s.additionalGroups)
+		s.record(user.JournalCreate, fmt.Sprintf("create user with uid %d", u.UID), "selected on AWS IAM", u, err)
 		if err != nil {
 			log.Printf("Failed to ensure user %q in the system: %s", u.Username, err)
+			res.failed++
 			continue
 		}
+		res.created++
+		state.Users[u.Username] = &user.ManagedUser{
+			Groups:      groupNames(u.Groups),
+			IAMUserID:   u.IAMUserID,
+			IAMUsername: u.IAMUsername,
+			Since:       time.Now(),
+		}
 		for _, g := range u.Groups {
 			log.Printf("Ensuring user %q in group %q", u.Username, g.Name)
 			err = g.EnsureUser(u)
+			s.record(user.JournalModify, fmt.Sprintf("add to group %q", g.Name), "granted by AWS IAM", u, err)
 			if err != nil {
 				log.Printf("Failed to ensure user %q in the system group %q: %s", u.Username, g.Name, err)
+				res.failed++
 				continue
 			}
 		}
+		if s.homeTemplate != nil {
+			delete(state.HomeFiles, u.Username)
+			if err = s.renderHome(u, state, true); err != nil {
+				res.failed++
+			}
+		}
+	}
+
+	// re-apply home directory templates to existing users
+	for _, u := range plan.Homes {
+		if stop.Err() != nil {
+			break
+		}
+		if err = s.renderHome(u, state, false); err != nil {
+			res.failed++
+		}
+	}
+
+	// reconcile group memberships of users that exist on both AWS IAM and the system
+	for _, m := range plan.Memberships {
+		if stop.Err() != nil {
+			break
+		}
+		if m.Action == user.MembershipAdd {
+			log.Printf("Adding user %q to group %q", m.Username, m.Groupname)
+			err = m.Group.EnsureUser(m.User)
+			s.record(user.JournalModify, fmt.Sprintf("add to group %q", m.Groupname), "granted by AWS IAM", m.User, err)
+		} else {
+			log.Printf("Removing user %q from group %q", m.Username, m.Groupname)
+			err = m.Group.RemoveUser(m.User)
+			s.record(user.JournalModify, fmt.Sprintf("remove from group %q", m.Groupname), "not granted by AWS IAM anymore", m.User, err)
+		}
+		if err != nil {
+			log.Printf("Failed to %s user %q membership of the system group %q: %s", m.Action, m.Username, m.Groupname, err)
+			res.failed++
+			continue
+		}
+	}
+
+	// update login shells
+	for _, c := range plan.Shells {
+		if stop.Err() != nil {
+			break
+		}
+		log.Printf("Changing user %q shell from %q to %q", c.Username, c.From, c.To)
+		err = c.User.UpdateShell()
+		s.record(user.JournalModify, fmt.Sprintf("change shell from %q to %q", c.From, c.To), "AWS IAM tags or sandbox setting changed", c.User, err)
+		if err != nil {
+			log.Printf("Failed to change user %q shell: %s", c.Username, err)
+			res.failed++
+			continue
+		}
+	}
+
+	// restore users pending removal that are back on AWS IAM
+	for _, u := range plan.Restore {
+		if stop.Err() != nil {
+			break
+		}
+		log.Printf("Restoring user %q, it is back on AWS IAM", u.Username)
+		err = u.Unlock()
+		s.record(user.JournalModify, "restore user", "selected on AWS IAM again", u, err)
+		if err != nil {
+			log.Printf("Failed to restore user %q: %s", u.Username, err)
+			res.failed++
+			continue
+		}
+		delete(state.Locks, u.Username)
+		delete(state.Removals, u.Username)
+	}
+
+	// lock accounts disabled on AWS IAM, unlock the ones enabled again and set expiration dates
+	for _, c := range plan.Accounts {
+		if stop.Err() != nil {
+			break
+		}
+		log.Printf("Changing user %q account: %s", c.Username, c)
+		err = c.Apply()
+		s.record(user.JournalModify, c.String(), c.Reason, c.User, err)
+		if err != nil {
+			log.Printf("Failed to change user %q account: %s", c.Username, err)
+			res.failed++
+			continue
+		}
+		switch c.Action {
+		case user.AccountLock:
+			state.Locks[c.Username] = c.Reason
+		case user.AccountUnlock:
+			delete(state.Locks, c.Username)
+		}
 	}
 
-	// remove system users that aren't on AWS IAM anymore
-	for _, u := range sysUsers.Diff(iamUsers) {
-		log.Printf("Removing user %q from the system", u.Username)
-		err = u.Remove()
+	// deprovision system users that aren't on AWS IAM anymore
+	for _, u := range plan.Remove {
+		if stop.Err() != nil {
+			break
+		}
+		deleted, err := s.deprovision(u, state, stringIn(u.Username, plan.Recreated))
 		if err != nil {
 			log.Printf("Failed to remove user %q from the system: %s", u.Username, err)
+			res.failed++
 			continue
 		}
+		if deleted {
+			res.removed++
+		}
+	}
+	err = state.Save()
+	if err != nil {
+		return res, fmt.Errorf("failed to save state: %s", err)
+	}
+	return res, nil
+}
+
+// deprovision removes an user in stages. First the user is locked, its
+// sessions terminated and its home directory archived, then after the
+// removal grace period the user is deleted, which is reported back.
+// Accounts of re-created AWS IAM users get their uid retired.
+func (s *syncer) deprovision(u *user.User, state *user.State, recreated bool) (bool, error) {
+	reason := "not selected on AWS IAM anymore"
+	if recreated {
+		reason = "AWS IAM user re-created with a new UserId"
+	}
+	record := state.Users[u.Username]
+	if record != nil {
+		u.IAMUserID = record.IAMUserID
+	}
+	removal, ok := state.Removals[u.Username]
+	if !ok {
+		archive, err := s.disable(u)
+		s.record(user.JournalModify, fmt.Sprintf("lock user and archive home to %q", archive), reason, u, err)
+		if err != nil {
+			return false, err
+		}
+		removal = &user.Removal{Archive: archive, Since: time.Now()}
+		state.Removals[u.Username] = removal
+	}
+	if deadline := removal.Since.Add(s.removalGracePeriod); time.Now().Before(deadline) {
+		log.Printf("User %q is locked and will be removed after %s", u.Username, deadline.Format(time.RFC3339))
+		return false, nil
+	}
+	log.Printf("Removing user %q from the system", u.Username)
+	err := u.Remove()
+	s.record(user.JournalRemove, "delete user", "removal grace period is over", u, err)
+	if err != nil {
+		return false, err
+	}
+	if recreated && record != nil {
+		state.RetireUID(u.Username, record.IAMUserID)
+	}
+	delete(state.Removals, u.Username)
+	delete(state.ExtraGroups, u.Username)
+	delete(state.HomeFiles, u.Username)
+	delete(state.Locks, u.Username)
+	delete(state.Users, u.Username)
+	return true, nil
+}
+
+// renderHome writes the home directory templates of an user, new users
+// get the templates over /etc/skel files while existing users keep the
+// files they edited
+func (s *syncer) renderHome(u *user.User, state *user.State, created bool) error {
+	checksums, ok := state.HomeFiles[u.Username]
+	if !ok {
+		checksums = map[string]string{}
+		state.HomeFiles[u.Username] = checksums
+	}
+	render, reason := s.homeTemplate.Apply, "home directory templates changed"
+	if created {
+		render, reason = s.homeTemplate.Provision, "home directory templates"
+	}
+	written, err := render(u, checksums)
+	if len(written) == 0 && err == nil {
+		return nil
+	}
+	if len(written) > 0 {
+		log.Printf("Rendered user %q home files: %s", u.Username, strings.Join(written, ", "))
+	}
+	s.record(user.JournalModify, fmt.Sprintf("render home files %s", strings.Join(written, ", ")), reason, u, err)
+	if err != nil {
+		log.Printf("Failed to render user %q home directory templates: %s", u.Username, err)
 	}
 	return err
 }
+
+// reportKeys logs the SSH public keys failing the key policy, returning their number
+func (s *syncer) reportKeys(entries []*user.KeyCacheEntry) int {
+	violations := 0
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		for _, v := range s.keyPolicy.Compliance(entry, time.Now()).Violations {
+			log.Printf("User %q SSH public key %q %s fails the key policy, authorized-keys drops it: %s", entry.IAMUsername, v.ID, v.Fingerprint, v.Reason)
+			violations++
+		}
+	}
+	return violations
+}
+
+// disable locks an user, terminates its sessions and archives its home directory
+func (s *syncer) disable(u *user.User) (string, error) {
+	log.Printf("Locking user %q", u.Username)
+	if err := u.Lock(); err != nil {
+		return "", err
+	}
+	log.Printf("Terminating user %q sessions", u.Username)
+	if err := u.Terminate(); err != nil {
+		return "", err
+	}
+	archive, err := u.Archive(s.archiveDir, s.root)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Archived user %q home directory to %q", u.Username, archive)
+	return archive, nil
+}
+
+// record appends a change to the journal, failing to do so is only logged
+func (s *syncer) record(action, change, reason string, u *user.User, err error) {
+	entry := &user.JournalEntry{
+		Action:      action,
+		Change:      change,
+		IAMUserID:   u.IAMUserID,
+		IAMUsername: u.IAMUsername,
+		Reason:      reason,
+		Time:        time.Now().UTC(),
+		Username:    u.Username,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err = s.journal.Append(entry); err != nil {
+		log.Printf("Failed to record user %q change on the journal: %s", u.Username, err)
+	}
+}
+
+// tagGroups returns the allowed extra groups from the user tags, except synced and additional groups which are managed by flags
+func (s *syncer) tagGroups(u *user.User) []string {
+	names := []string{}
+	for _, name := range u.TagGroups() {
+		if !stringIn(name, s.allowedTagGroups) || stringIn(name, groupNames(s.systemGroups())) || stringIn(name, s.additionalGroups) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// systemGroups returns the synced system groups, including the selector group when users are selected
+func (s *syncer) systemGroups() []*user.Group {
+	if s.selector.Empty() || groupIn(s.selector.Group.Name, s.groups) {
+		return s.groups
+	}
+	return append(append([]*user.Group{}, s.groups...), s.selector.Group)
+}
+
+// groupIn checks wether a group name is in a list of groups
+func groupIn(name string, groups []*user.Group) bool {
+	return stringIn(name, groupNames(groups))
+}
+
+// groupNames returns the names of a list of groups
+func groupNames(groups []*user.Group) []string {
+	names := []string{}
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names
+}
@@ -34,7 +34,7 @@ var Toolbox = cli.Command{
 		},
 		cli.StringFlag{
 			Name:  "username",
-			Usage: "AWS IAM username for the session.",
+			Usage: "System username for the session.",
 		},
 	},
 }
@@ -50,6 +50,10 @@ func toolboxSessionMain(ctx *cli.Context) (err error) {
 	if username == "" {
 		return fmt.Errorf("username argument is required.")
 	}
+	// the username names the session container
+	if !user.ValidUsername(username) {
+		return fmt.Errorf("invalid username %q.", username)
+	}
 	log.Println("Opening session")
 	err = ensureContainer(username, image, sshArgs)
 	if err != nil {
@@ -74,6 +78,10 @@ func attachToContainer(username string) error {
 // ensureContainer ensure that user's toolbox container exists
 func ensureContainer(username, image, command string) error {
 	usr := &user.User{Username: username}
+	uid, err := usr.Uid()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve user uid: %s", err)
+	}
 	containerID, err := exec.Command(DOCKER, "container", "ls", "--quiet", "--filter", "name="+usr.Username).Output()
 	if err != nil {
 		return fmt.Errorf("failed to check if container already running: %s", err)
@@ -110,7 +118,7 @@ func ensureContainer(username, image, command string) error {
 		fmt.Sprintf("--mount=type=bind,source=/etc/passwd,destination=/etc/passwd,bind-propagation=rprivate,readonly"),
 		fmt.Sprintf("--mount=type=bind,source=%s/.aws,destination=%s/.aws,bind-propagation=rprivate,readonly", usr.HomeDir(), usr.HomeDir()),
 		fmt.Sprintf("--mount=type=bind,source=%s/data,destination=%s/data,bind-propagation=rprivate", usr.HomeDir(), usr.HomeDir()),
-		"--user", fmt.Sprintf("%d:%d", usr.Uid(), usr.Uid()),
+		"--user", fmt.Sprintf("%d:%d", uid, uid),
 		fmt.Sprintf("--workdir=%s/data", usr.HomeDir()),
 	}
 	sshAuthSock := os.Getenv("SSH_AUTH_SOCK")
@@ -6,4 +6,6 @@ require (
 	github.com/google/shlex v0.0.0-20181106134648-c34317bd91bf
 	github.com/prometheus/client_golang v0.9.2
 	github.com/urfave/cli v1.20.0
+	golang.org/x/crypto v0.9.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -20,7 +20,9 @@ func main() {
 	app.Version = fmt.Sprintf("%s %s", VERSION, runtime.Version())
 	app.Commands = []cli.Command{
 		cmd.AuthorizedKeys,
+		cmd.CA,
 		cmd.PAM,
+		cmd.Principals,
 		cmd.Proxy,
 		cmd.Sync,
 		cmd.Toolbox,
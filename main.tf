@@ -165,11 +165,15 @@ data "template_file" "bastrd_policy" {
       "Sid": "iam",
       "Effect": "Allow",
       "Action": [
+        "iam:GetAccessKeyLastUsed",
         "iam:GetGroup",
         "iam:GetSSHPublicKey",
+        "iam:GetUser",
         "iam:ListAccessKeys",
         "iam:ListGroupsForUser",
         "iam:ListSSHPublicKeys",
+        "iam:ListUserTags",
+        "iam:ListUsers",
         "sts:GetCallerIdentity"
       ],
       "Resource": ["*"]
@@ -11,32 +11,26 @@ import (
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
-// NewSessionCredentials creates time restrained credentials.
-func NewSessionCredentials(username, secretKey, mfaToken string, duration time.Duration) (*sts.Credentials, error) {
-	iamSvc := iam.New(session.New())
-	accessKeys, err := iamSvc.ListAccessKeys(&iam.ListAccessKeysInput{
-		UserName: aws.String(username),
-	})
+// NewSessionCredentials creates time restrained credentials, looking up the
+// user access key on iamSvc, which may belong to another account. The MFA
+// device is looked up on the account of the user credentials.
+func NewSessionCredentials(iamSvc IAM, username, secretKey, mfaToken string, duration time.Duration) (*sts.Credentials, error) {
+	accessKey, err := activeAccessKey(iamSvc, username)
 	if err != nil {
 		return nil, err
 	}
-	if len(accessKeys.AccessKeyMetadata) == 0 {
-		return nil, fmt.Errorf("No matching access key found.")
-	}
-	accessKey := accessKeys.AccessKeyMetadata[0]
-	if *accessKey.Status != iam.StatusTypeActive {
-		return nil, fmt.Errorf("No active access key found.")
+	userSession, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(*accessKey.AccessKeyId, secretKey, ""),
+	})
+	if err != nil {
+		return nil, err
 	}
-	stsSvc := sts.New(session.New())
+	stsSvc := sts.New(userSession)
 	accountID, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
 	if err != nil {
 		return nil, err
 	}
 	mfaArn := fmt.Sprintf("arn:aws:iam::%s:mfa/%s", *accountID.Account, username)
-	userSession, err := session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(*accessKey.AccessKeyId, secretKey, ""),
-	})
-	stsSvc = sts.New(userSession)
 	creds, err := stsSvc.GetSessionToken(&sts.GetSessionTokenInput{
 		DurationSeconds: aws.Int64(int64(duration.Seconds())),
 		SerialNumber:    aws.String(mfaArn),
@@ -47,3 +41,31 @@ func NewSessionCredentials(username, secretKey, mfaToken string, duration time.D
 	}
 	return creds.Credentials, nil
 }
+
+// activeAccessKey returns the first active access key of an user, going through all the listing pages
+func activeAccessKey(iamSvc IAM, username string) (*iam.AccessKeyMetadata, error) {
+	input := &iam.ListAccessKeysInput{
+		UserName: aws.String(username),
+	}
+	found := false
+	for {
+		accessKeys, err := iamSvc.ListAccessKeys(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, accessKey := range accessKeys.AccessKeyMetadata {
+			found = true
+			if aws.StringValue(accessKey.Status) == iam.StatusTypeActive {
+				return accessKey, nil
+			}
+		}
+		if !aws.BoolValue(accessKeys.IsTruncated) {
+			break
+		}
+		input.Marker = accessKeys.Marker
+	}
+	if !found {
+		return nil, fmt.Errorf("No matching access key found.")
+	}
+	return nil, fmt.Errorf("No active access key found.")
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// fakeIAM returns one access key per page
+type fakeIAM struct {
+	statuses []string
+}
+
+func (f *fakeIAM) ListAccessKeys(input *iam.ListAccessKeysInput) (*iam.ListAccessKeysOutput, error) {
+	i := 0
+	if input.Marker != nil {
+		i, _ = strconv.Atoi(*input.Marker)
+	}
+	out := &iam.ListAccessKeysOutput{IsTruncated: aws.Bool(false)}
+	if i >= len(f.statuses) {
+		return out, nil
+	}
+	out.AccessKeyMetadata = []*iam.AccessKeyMetadata{
+		{AccessKeyId: aws.String("AKIA" + strconv.Itoa(i)), Status: aws.String(f.statuses[i])},
+	}
+	if i+1 < len(f.statuses) {
+		out.IsTruncated = aws.Bool(true)
+		out.Marker = aws.String(strconv.Itoa(i + 1))
+	}
+	return out, nil
+}
+
+func TestActiveAccessKeyPagination(t *testing.T) {
+	svc := &fakeIAM{statuses: []string{iam.StatusTypeInactive, iam.StatusTypeActive}}
+	key, err := activeAccessKey(svc, "rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *key.AccessKeyId != "AKIA1" {
+		t.Errorf("expected active key from the second page, got %q", *key.AccessKeyId)
+	}
+}
+
+func TestActiveAccessKeyErrors(t *testing.T) {
+	if _, err := activeAccessKey(&fakeIAM{}, "rochacon"); err == nil || err.Error() != "No matching access key found." {
+		t.Errorf("unexpected error for user without keys: %v", err)
+	}
+	svc := &fakeIAM{statuses: []string{iam.StatusTypeInactive}}
+	if _, err := activeAccessKey(svc, "rochacon"); err == nil || err.Error() != "No active access key found." {
+		t.Errorf("unexpected error for user without active keys: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package ca
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GroupPrincipalPrefix prefixes the certificate principals granted by AWS IAM
+// groups, so they never match an username
+const GroupPrincipalPrefix = "group:"
+
+// clockSkew backdates certificates to tolerate hosts with late clocks
+const clockSkew = 5 * time.Minute
+
+// DefaultExtensions are the certificate extensions ssh-keygen grants by default,
+// port forwarding allows ProxyJump through the bastion to downstream hosts
+var DefaultExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// Authority signs short-lived SSH user certificates
+type Authority struct {
+	Extensions map[string]string
+	Signer     ssh.Signer
+	// Validity is how long certificates are valid for
+	Validity time.Duration
+}
+
+// New instantiates an Authority with the default extensions
+func New(signer ssh.Signer, validity time.Duration) *Authority {
+	return &Authority{Extensions: DefaultExtensions, Signer: signer, Validity: validity}
+}
+
+// LoadSigner reads an unencrypted CA private key, which must not be
+// accessible by group or others
+func LoadSigner(path string) (ssh.Signer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("CA key %q must not be accessible by group or others, mode is %s", path, info.Mode().Perm())
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key %q: %s", path, err)
+	}
+	return signer, nil
+}
+
+// Principals returns the certificate principals of an user, its system
+// username and its AWS IAM groups prefixed by GroupPrincipalPrefix
+func Principals(username string, groups []string) []string {
+	principals := []string{username}
+	for _, group := range groups {
+		principals = append(principals, GroupPrincipalPrefix+group)
+	}
+	return principals
+}
+
+// Sign issues an user certificate for key, valid from now for the authority validity
+func (a *Authority) Sign(key ssh.PublicKey, keyID string, principals []string) (*ssh.Certificate, error) {
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("refusing to sign certificate %q without principals", keyID)
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	extensions := map[string]string{}
+	for name, value := range a.Extensions {
+		extensions[name] = value
+	}
+	cert := &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		Key:             key,
+		KeyId:           keyID,
+		Permissions:     ssh.Permissions{Extensions: extensions},
+		Serial:          binary.BigEndian.Uint64(serial),
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(a.Validity).Unix()),
+		ValidPrincipals: principals,
+	}
+	if err := cert.SignCert(rand.Reader, a.Signer); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate %q: %s", keyID, err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,106 @@
+package ca
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeKey writes a new ed25519 private key file
+func writeKey(t *testing.T, path string, mode os.FileMode) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), mode); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestLoadSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey(t, filepath.Join(dir, "ca"), 0600)
+	if _, err = LoadSigner(filepath.Join(dir, "ca")); err != nil {
+		t.Error(err)
+	}
+	writeKey(t, filepath.Join(dir, "readable"), 0644)
+	if _, err = LoadSigner(filepath.Join(dir, "readable")); err == nil {
+		t.Errorf("expected CA key readable by others to fail")
+	}
+}
+
+func TestAuthoritySign(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(userPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principals := Principals("rochacon", []string{"bastrd", "admins"})
+	if !reflect.DeepEqual(principals, []string{"rochacon", "group:bastrd", "group:admins"}) {
+		t.Errorf("unexpected principals %#v", principals)
+	}
+	authority := New(signer, time.Hour)
+	cert, err := authority.Sign(key, "rochacon", principals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.CertType != ssh.UserCert || cert.KeyId != "rochacon" {
+		t.Errorf("unexpected certificate %#v", cert)
+	}
+	if _, ok := cert.Permissions.Extensions["permit-port-forwarding"]; !ok {
+		t.Errorf("expected port forwarding to be permitted, got %#v", cert.Permissions.Extensions)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return reflect.DeepEqual(auth.Marshal(), signer.PublicKey().Marshal())
+		},
+	}
+	if err = checker.CheckCert("rochacon", cert); err != nil {
+		t.Errorf("expected certificate to be valid for rochacon: %s", err)
+	}
+	if err = checker.CheckCert("group:admins", cert); err != nil {
+		t.Errorf("expected certificate to be valid for group:admins: %s", err)
+	}
+	if err = checker.CheckCert("root", cert); err == nil {
+		t.Errorf("expected certificate to be invalid for root")
+	}
+	checker.Clock = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err = checker.CheckCert("rochacon", cert); err == nil {
+		t.Errorf("expected certificate to expire")
+	}
+
+	if _, err = authority.Sign(key, "rochacon", nil); err == nil {
+		t.Errorf("expected certificate without principals to fail")
+	}
+}
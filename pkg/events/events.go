@@ -0,0 +1,161 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// iamEvents are the AWS IAM API calls that affect synced users
+var iamEvents = map[string]bool{
+	"AddUserToGroup":      true,
+	"CreateUser":          true,
+	"DeleteSSHPublicKey":  true,
+	"DeleteUser":          true,
+	"RemoveUserFromGroup": true,
+	"TagUser":             true,
+	"UntagUser":           true,
+	"UpdateSSHPublicKey":  true,
+	"UpdateUser":          true,
+	"UploadSSHPublicKey":  true,
+}
+
+// SQS interface holds required method signatures of SQS for easier test mocking
+type SQS interface {
+	DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+	ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+}
+
+// Event is an AWS IAM change affecting an user
+type Event struct {
+	// Group is the group name for membership changes
+	Group string
+	// Name is the IAM API call name, e.g. AddUserToGroup
+	Name string
+	// Username is the affected IAM user name
+	Username string
+}
+
+// cloudTrailEvent holds the relevant fields of a CloudTrail record
+type cloudTrailEvent struct {
+	EventName         string `json:"eventName"`
+	EventSource       string `json:"eventSource"`
+	ErrorCode         string `json:"errorCode"`
+	RequestParameters struct {
+		GroupName   string `json:"groupName"`
+		NewUserName string `json:"newUserName"`
+		UserName    string `json:"userName"`
+	} `json:"requestParameters"`
+}
+
+// message holds the envelopes an IAM event may be wrapped in: EventBridge
+// events, CloudTrail log records and SNS notifications
+type message struct {
+	Detail  *cloudTrailEvent   `json:"detail"`
+	Message string             `json:"Message"`
+	Records []*cloudTrailEvent `json:"Records"`
+	Type    string             `json:"Type"`
+}
+
+// Parse extracts the AWS IAM user events from a message body, unrelated and
+// failed API calls are ignored
+func Parse(body string) ([]*Event, error) {
+	msg := &message{}
+	if err := json.Unmarshal([]byte(body), msg); err != nil {
+		return nil, fmt.Errorf("invalid event message: %s", err)
+	}
+	if msg.Type == "Notification" && msg.Message != "" {
+		return Parse(msg.Message)
+	}
+	records := msg.Records
+	if msg.Detail != nil {
+		records = append(records, msg.Detail)
+	}
+	events := []*Event{}
+	for _, r := range records {
+		if r.EventSource != "iam.amazonaws.com" || r.ErrorCode != "" || !iamEvents[r.EventName] {
+			continue
+		}
+		params := r.RequestParameters
+		if params.UserName == "" {
+			continue
+		}
+		events = append(events, &Event{Group: params.GroupName, Name: r.EventName, Username: params.UserName})
+		if params.NewUserName != "" {
+			events = append(events, &Event{Name: r.EventName, Username: params.NewUserName})
+		}
+	}
+	return events, nil
+}
+
+// Consumer receives AWS IAM events from an SQS queue
+type Consumer struct {
+	QueueURL string
+	SQS      SQS
+	// WaitTime is the long polling duration
+	WaitTime time.Duration
+}
+
+// Run receives messages until ctx is done, calling handle for each event.
+// Messages are deleted once all their events are handled, so failed events
+// are redelivered after the queue visibility timeout. Invalid messages are
+// dropped.
+func (c *Consumer) Run(ctx context.Context, handle func(*Event) error) error {
+	waitTime := c.WaitTime
+	if waitTime == 0 {
+		waitTime = 20 * time.Second
+	}
+	for {
+		out, err := c.SQS.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			MaxNumberOfMessages: aws.Int64(10),
+			QueueUrl:            aws.String(c.QueueURL),
+			WaitTimeSeconds:     aws.Int64(int64(waitTime.Seconds())),
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("events: failed to receive messages: %s", err)
+			select {
+			case <-time.After(waitTime):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		for _, msg := range out.Messages {
+			if !c.handleMessage(msg, handle) {
+				continue
+			}
+			_, err = c.SQS.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(c.QueueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				log.Printf("events: failed to delete message %q: %s", aws.StringValue(msg.MessageId), err)
+			}
+		}
+	}
+}
+
+// handleMessage handles a message events, reporting wether it can be deleted
+func (c *Consumer) handleMessage(msg *sqs.Message, handle func(*Event) error) bool {
+	events, err := Parse(aws.StringValue(msg.Body))
+	if err != nil {
+		log.Printf("events: dropping message %q: %s", aws.StringValue(msg.MessageId), err)
+		return true
+	}
+	for _, event := range events {
+		if err = handle(event); err != nil {
+			log.Printf("events: failed to handle %s event for user %q: %s", event.Name, event.Username, err)
+			return false
+		}
+	}
+	return true
+}
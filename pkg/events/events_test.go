@@ -0,0 +1,122 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const eventBridgeMessage = `{
+  "detail-type": "AWS API Call via CloudTrail",
+  "source": "aws.iam",
+  "detail": {
+    "eventSource": "iam.amazonaws.com",
+    "eventName": "AddUserToGroup",
+    "requestParameters": {"groupName": "devs", "userName": "rochacon"}
+  }
+}`
+
+const cloudTrailMessage = `{
+  "Records": [
+    {"eventSource": "iam.amazonaws.com", "eventName": "UploadSSHPublicKey", "requestParameters": {"userName": "rochacon"}},
+    {"eventSource": "iam.amazonaws.com", "eventName": "DeleteUser", "errorCode": "NoSuchEntityException", "requestParameters": {"userName": "ghost"}},
+    {"eventSource": "iam.amazonaws.com", "eventName": "CreateRole", "requestParameters": {"roleName": "admin"}},
+    {"eventSource": "s3.amazonaws.com", "eventName": "DeleteUser", "requestParameters": {"userName": "rochacon"}},
+    {"eventSource": "iam.amazonaws.com", "eventName": "UpdateUser", "requestParameters": {"userName": "old", "newUserName": "new"}}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	sns, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": eventBridgeMessage})
+	tests := []struct {
+		body     string
+		expected []Event
+	}{
+		{eventBridgeMessage, []Event{{Group: "devs", Name: "AddUserToGroup", Username: "rochacon"}}},
+		{string(sns), []Event{{Group: "devs", Name: "AddUserToGroup", Username: "rochacon"}}},
+		{cloudTrailMessage, []Event{
+			{Name: "UploadSSHPublicKey", Username: "rochacon"},
+			{Name: "UpdateUser", Username: "old"},
+			{Name: "UpdateUser", Username: "new"},
+		}},
+		{`{}`, []Event{}},
+	}
+	for _, test := range tests {
+		events, err := Parse(test.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != len(test.expected) {
+			t.Fatalf("expected %d events, got %d for %s", len(test.expected), len(events), test.body)
+		}
+		for i, e := range events {
+			if *e != test.expected[i] {
+				t.Errorf("expected event %#v, got %#v", test.expected[i], e)
+			}
+		}
+	}
+	if _, err := Parse("not json"); err == nil {
+		t.Error("expected invalid messages to fail")
+	}
+}
+
+// fakeSQS serves a fixed list of messages and cancels the consumer once they are delivered
+type fakeSQS struct {
+	cancel   func()
+	deleted  []string
+	messages []*sqs.Message
+}
+
+func (f *fakeSQS) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if len(f.messages) == 0 {
+		f.cancel()
+		return nil, ctx.Err()
+	}
+	out := &sqs.ReceiveMessageOutput{Messages: f.messages}
+	f.messages = nil
+	return out, nil
+}
+
+func TestConsumerRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := func(eventName, username string) *string {
+		return aws.String(fmt.Sprintf(`{"detail": {"eventSource": "iam.amazonaws.com", "eventName": %q, "requestParameters": {"userName": %q}}}`, eventName, username))
+	}
+	svc := &fakeSQS{
+		cancel: cancel,
+		messages: []*sqs.Message{
+			{Body: body("DeleteUser", "rochacon"), ReceiptHandle: aws.String("handled")},
+			{Body: body("DeleteUser", "broken"), ReceiptHandle: aws.String("failed")},
+			{Body: aws.String("garbage"), ReceiptHandle: aws.String("invalid")},
+		},
+	}
+	handled := []string{}
+	consumer := &Consumer{QueueURL: "http://localhost:9324/queue/iam", SQS: svc}
+	err := consumer.Run(ctx, func(e *Event) error {
+		handled = append(handled, e.Username)
+		if e.Username == "broken" {
+			return fmt.Errorf("sync failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(handled) != "[rochacon broken]" {
+		t.Errorf("unexpected handled users %v", handled)
+	}
+	if fmt.Sprint(svc.deleted) != "[handled invalid]" {
+		t.Errorf("expected failed messages to be kept for redelivery, deleted %v", svc.deleted)
+	}
+}
@@ -14,8 +14,10 @@ import (
 	"time"
 
 	"github.com/rochacon/bastrd/pkg/auth"
+	"github.com/rochacon/bastrd/pkg/user"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,12 +27,13 @@ import (
 type Server struct {
 	Addr              string
 	AllowedGroups     []string
-	IAM               *iam.IAM
+	Directory         user.Directory
+	IAM               auth.IAM
 	SecretKey         []byte
 	SessionCookieName string
 	Upstream          *url.URL
 	upstreamProxy     *httputil.ReverseProxy
-	groupCache        map[string]*iam.GetGroupOutput
+	groupCache        map[string][]*user.Identity
 	GroupCachePeriod  time.Duration
 	groupCacheMutex   *sync.RWMutex
 }
@@ -39,6 +42,7 @@ type Server struct {
 func New(addr string, secretKey []byte, upstream *url.URL) *Server {
 	s := &Server{
 		Addr:              addr,
+		IAM:               user.NewIAMClient(iam.New(session.New(), &aws.Config{MaxRetries: aws.Int(0)}), nil),
 		SecretKey:         secretKey,
 		SessionCookieName: "sessionToken",
 		Upstream:          upstream,
@@ -51,7 +55,7 @@ func New(addr string, secretKey []byte, upstream *url.URL) *Server {
 // groupCacheManager manages the allowed groups cache
 func (s *Server) groupCacheManager() error {
 	if s.groupCache == nil {
-		s.groupCache = map[string]*iam.GetGroupOutput{}
+		s.groupCache = map[string][]*user.Identity{}
 	}
 	if len(s.AllowedGroups) == 0 {
 		return fmt.Errorf("empty list of allowed groups, disabling group cache")
@@ -62,12 +66,12 @@ func (s *Server) groupCacheManager() error {
 			log.Printf("group cache sync started")
 			s.groupCacheMutex.Lock()
 			for _, group := range s.AllowedGroups {
-				grp, err := s.IAM.GetGroup(&iam.GetGroupInput{GroupName: aws.String(group)})
+				members, err := s.Directory.GroupMembers(group)
 				if err != nil {
 					log.Printf("failed to sync group %q: %s", group, err)
 					continue
 				}
-				s.groupCache[*grp.Group.GroupName] = grp
+				s.groupCache[group] = members
 			}
 			s.groupCacheMutex.Unlock()
 			log.Printf("group cache sync finished")
@@ -91,7 +95,7 @@ func (s *Server) ListenAndServe() error {
 	mux.Handle("/metrics", promhttp.Handler())
 	log.Println("Listening on", s.Addr)
 	drained := make(chan error)
-	sigint := make(chan os.Signal)
+	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
 	srv := &http.Server{
 		Addr:    s.Addr,
@@ -184,7 +188,7 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	expiration := time.Duration(time.Hour * 2)
 	secretKey, mfaToken := password[:lenPassword-6], password[lenPassword-6:]
-	_, err := auth.NewSessionCredentials(username, secretKey, mfaToken, expiration)
+	_, err := auth.NewSessionCredentials(s.IAM, username, secretKey, mfaToken, expiration)
 	if err != nil {
 		log.Printf("Failed authentication for %q: %s", username, err)
 		w.Header().Set("WWW-Authenticate", "Basic realm=\"Invalid credentials\"")
@@ -271,9 +275,9 @@ func (s *Server) userInAllowedGroups(username string) bool {
 	}
 	s.groupCacheMutex.RLock()
 	defer s.groupCacheMutex.RUnlock()
-	for _, group := range s.groupCache {
-		for _, user := range group.Users {
-			if *user.UserName == username {
+	for _, members := range s.groupCache {
+		for _, member := range members {
+			if member.Username == username {
 				return true
 			}
 		}
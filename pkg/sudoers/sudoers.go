@@ -0,0 +1,270 @@
+package sudoers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultDir is where sudo includes drop-in files from
+const DefaultDir = "/etc/sudoers.d"
+
+// filePrefix identifies files managed by bastrd, sudo ignores files
+// containing dots, so group names are escaped
+const filePrefix = "bastrd-"
+
+// Change actions
+const (
+	ActionInstall = "install"
+	ActionRemove  = "remove"
+	ActionUpdate  = "update"
+)
+
+var (
+	// groupNameRe matches group names safe to be used on sudoers without
+	// quoting, "=" would end the user list
+	groupNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@+-]*$`)
+	// hostListRe matches a leading host list, e.g. "ALL=" or "web1, !web2 =",
+	// hosts never start with a slash nor hold spaces, unlike commands arguments
+	hostListRe = regexp.MustCompile(`^!*[A-Za-z0-9_.+-][A-Za-z0-9_.+/-]*(\s*,\s*!*[A-Za-z0-9_.+-][A-Za-z0-9_.+/-]*)*\s*=`)
+	// ruleRe is a basic sudoers user specification check used when visudo is unavailable
+	ruleRe = regexp.MustCompile(`^%[^\s=]+\s+[^=]+=\s*(\([^)]*\)\s*)?[^\s].*$`)
+	// visudoPaths are searched for visudo, in order
+	visudoPaths = []string{"/usr/sbin/visudo", "/sbin/visudo", "/usr/bin/visudo"}
+)
+
+// Rule maps a group to a sudo user specification
+type Rule struct {
+	Group string
+	Spec  string
+}
+
+// ParseRule parses a group:spec rule, e.g. prod-admins:ALL.
+// Specs without an host part get ALL=(ALL) prepended, so
+// "admins:NOPASSWD: ALL" renders as "%admins ALL=(ALL) NOPASSWD: ALL",
+// or only ALL= when they start with a runas list, e.g. "(root) /bin/ls".
+func ParseRule(s string) (*Rule, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return nil, fmt.Errorf("invalid sudo rule %q, expected group:spec", s)
+	}
+	group, spec := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if !groupNameRe.MatchString(group) {
+		return nil, fmt.Errorf("invalid sudo rule %q, unsupported group name %q", s, group)
+	}
+	if strings.ContainsAny(spec, "\n\r") {
+		return nil, fmt.Errorf("invalid sudo rule %q, spec must be a single line", s)
+	}
+	if strings.HasPrefix(spec, "(") {
+		spec = "ALL=" + spec
+	} else if !hostListRe.MatchString(spec) {
+		spec = "ALL=(ALL) " + spec
+	}
+	return &Rule{Group: group, Spec: spec}, nil
+}
+
+// String renders the rule as a sudoers user specification
+func (r *Rule) String() string {
+	return fmt.Sprintf("%%%s %s", r.Group, r.Spec)
+}
+
+// Manager installs and removes bastrd sudoers drop-in files
+type Manager struct {
+	// Dir is the sudoers drop-in directory, defaults to DefaultDir
+	Dir string
+}
+
+// Change describes a managed sudoers file being installed, updated or removed
+type Change struct {
+	Action string `json:"action"`
+	File   string `json:"file"`
+	// Group is the group granted by the file, empty for removals
+	Group   string `json:"group,omitempty"`
+	content []byte
+}
+
+// String renders a human readable description of the change
+func (c *Change) String() string {
+	if c.Action == ActionRemove {
+		return fmt.Sprintf("remove sudoers file %q", c.File)
+	}
+	return fmt.Sprintf("%s sudoers file %q for group %q", c.Action, c.File, c.Group)
+}
+
+// Plan computes the changes required to install one file per group for
+// the given rules and remove managed files of groups without rules
+func (m *Manager) Plan(rules []*Rule) ([]*Change, error) {
+	changes := []*Change{}
+	files := render(rules)
+	existing, err := m.managedFiles()
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for group := range files {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		name := fileName(group)
+		current, err := ioutil.ReadFile(filepath.Join(m.dir(), name))
+		if err == nil && bytes.Equal(current, files[group]) {
+			continue
+		}
+		action := ActionInstall
+		if err == nil {
+			action = ActionUpdate
+		}
+		changes = append(changes, &Change{Action: action, File: name, Group: group, content: files[group]})
+	}
+	for _, name := range existing {
+		if _, ok := files[fileGroup(name)]; ok {
+			continue
+		}
+		changes = append(changes, &Change{Action: ActionRemove, File: name})
+	}
+	return changes, nil
+}
+
+// Sync applies the changes computed by Plan, validating files before install
+func (m *Manager) Sync(rules []*Rule) error {
+	changes, err := m.Plan(rules)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.Action == ActionRemove {
+			log.Printf("Removing sudoers file %q", c.File)
+			err = os.Remove(filepath.Join(m.dir(), c.File))
+		} else {
+			log.Printf("Installing sudoers file %q", c.File)
+			err = m.install(c.File, c.content)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dir returns the sudoers drop-in directory
+func (m *Manager) dir() string {
+	if m.Dir == "" {
+		return DefaultDir
+	}
+	return m.Dir
+}
+
+// managedFiles lists the files managed by bastrd
+func (m *Manager) managedFiles() ([]string, error) {
+	names := []string{}
+	entries, err := ioutil.ReadDir(m.dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return names, nil
+		}
+		return names, err
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasPrefix(entry.Name(), filePrefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// install validates a file content and atomically moves it in place
+func (m *Manager) install(name string, content []byte) error {
+	if err := os.MkdirAll(m.dir(), 0750); err != nil {
+		return err
+	}
+	// sudo skips files containing a dot, so the temporary file is never included
+	fp, err := ioutil.TempFile(m.dir(), "."+name+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err = fp.Write(content); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Chmod(0440); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	if err = Validate(fp.Name()); err != nil {
+		return fmt.Errorf("invalid sudoers file %q: %s", name, err)
+	}
+	return os.Rename(fp.Name(), filepath.Join(m.dir(), name))
+}
+
+// Validate checks a sudoers file syntax with visudo -c, falling back to a
+// basic check of bastrd generated rules when visudo is unavailable
+func Validate(path string) error {
+	for _, visudo := range visudoPaths {
+		if _, err := os.Stat(visudo); err != nil {
+			continue
+		}
+		out, err := exec.Command(visudo, "-c", "-q", "-f", path).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %q", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !ruleRe.MatchString(line) {
+			return fmt.Errorf("syntax error on line %d: %q", i+1, line)
+		}
+	}
+	return nil
+}
+
+// render groups rules per group and renders each group file content, by group name
+func render(rules []*Rule) map[string][]byte {
+	byGroup := map[string][]*Rule{}
+	for _, r := range rules {
+		byGroup[r.Group] = append(byGroup[r.Group], r)
+	}
+	files := map[string][]byte{}
+	for group, groupRules := range byGroup {
+		buf := &bytes.Buffer{}
+		buf.WriteString("# Managed by bastrd sync, do not edit.\n")
+		specs := []string{}
+		for _, r := range groupRules {
+			specs = append(specs, r.String())
+		}
+		sort.Strings(specs)
+		buf.WriteString(strings.Join(specs, "\n") + "\n")
+		files[group] = buf.Bytes()
+	}
+	return files
+}
+
+// fileName returns the drop-in file name for a group. Dots are escaped as
+// %2e, group names never hold a percent sign so names never collide.
+func fileName(group string) string {
+	return filePrefix + strings.Replace(group, ".", "%2e", -1)
+}
+
+// fileGroup returns the group of a drop-in file name, reverting fileName
+func fileGroup(name string) string {
+	return strings.Replace(strings.TrimPrefix(name, filePrefix), "%2e", ".", -1)
+}
@@ -0,0 +1,85 @@
+package sudoers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := map[string]string{
+		"prod-admins:ALL":                   "%prod-admins ALL=(ALL) ALL",
+		"admins:NOPASSWD: ALL":              "%admins ALL=(ALL) NOPASSWD: ALL",
+		"ops:ALL=(root) /usr/bin/systemctl": "%ops ALL=(root) /usr/bin/systemctl",
+		"ops:NOPASSWD: /bin/x --o=1":        "%ops ALL=(ALL) NOPASSWD: /bin/x --o=1",
+		"ops:(root) /bin/x --o=1":           "%ops ALL=(root) /bin/x --o=1",
+		"ops:/bin/x --o=1":                  "%ops ALL=(ALL) /bin/x --o=1",
+		"ops:web1, !web2 = /bin/x":          "%ops web1, !web2 = /bin/x",
+	}
+	for input, expected := range cases {
+		r, err := ParseRule(input)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", input, err)
+			continue
+		}
+		if r.String() != expected {
+			t.Errorf("unexpected rule for %q: got %q expected %q", input, r, expected)
+		}
+	}
+	for _, input := range []string{"admins", "admins:", "bad group:ALL", ":ALL", "a=b:ALL"} {
+		if _, err := ParseRule(input); err == nil {
+			t.Errorf("expected error parsing %q", input)
+		}
+	}
+}
+
+func TestManagerSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd-sudoers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "default"), []byte("root ALL=(ALL) ALL\n"), 0440); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "bastrd-old-admins"), []byte("%old-admins ALL=(ALL) ALL\n"), 0440); err != nil {
+		t.Fatal(err)
+	}
+	rule, _ := ParseRule("prod.admins:ALL")
+	other, _ := ParseRule("prod_admins:NOPASSWD: ALL")
+	m := &Manager{Dir: dir}
+	changes, err := m.Plan([]*Rule{rule, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[0].String() != `install sudoers file "bastrd-prod%2eadmins" for group "prod.admins"` || changes[2].String() != `remove sudoers file "bastrd-old-admins"` {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	if err = m.Sync([]*Rule{rule, other}); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = m.Plan([]*Rule{rule, other}); err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes after sync, got %v: %v", changes, err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "bastrd-prod%2eadmins"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "# Managed by bastrd sync, do not edit.\n%prod.admins ALL=(ALL) ALL\n" {
+		t.Errorf("unexpected sudoers content: %q", content)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "bastrd-old-admins")); !os.IsNotExist(err) {
+		t.Errorf("expected stale managed file to be removed: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "default")); err != nil {
+		t.Errorf("unmanaged file should be kept: %s", err)
+	}
+	if content, err = ioutil.ReadFile(filepath.Join(dir, "bastrd-prod_admins")); err != nil || string(content) != "# Managed by bastrd sync, do not edit.\n%prod_admins ALL=(ALL) NOPASSWD: ALL\n" {
+		t.Errorf("unexpected sudoers content: %q: %v", content, err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("unexpected leftover files: %d entries", len(entries))
+	}
+}
@@ -6,8 +6,13 @@ import (
 
 // IAM interface holds required method signatures of IAM for easier test mocking
 type IAM interface {
+	GetAccessKeyLastUsed(input *iam.GetAccessKeyLastUsedInput) (*iam.GetAccessKeyLastUsedOutput, error)
 	GetGroup(input *iam.GetGroupInput) (*iam.GetGroupOutput, error)
 	GetSSHPublicKey(input *iam.GetSSHPublicKeyInput) (*iam.GetSSHPublicKeyOutput, error)
+	GetUser(input *iam.GetUserInput) (*iam.GetUserOutput, error)
+	ListAccessKeys(input *iam.ListAccessKeysInput) (*iam.ListAccessKeysOutput, error)
 	ListGroupsForUser(input *iam.ListGroupsForUserInput) (*iam.ListGroupsForUserOutput, error)
 	ListSSHPublicKeys(input *iam.ListSSHPublicKeysInput) (*iam.ListSSHPublicKeysOutput, error)
+	ListUserTags(input *iam.ListUserTagsInput) (*iam.ListUserTagsOutput, error)
+	ListUsers(input *iam.ListUsersInput) (*iam.ListUsersOutput, error)
 }
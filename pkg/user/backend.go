@@ -0,0 +1,95 @@
+package user
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Account is a system user account entry
+type Account struct {
+	Gecos  string
+	GID    uint32
+	Groups []string
+	Home   string
+	Name   string
+	Shell  string
+	UID    uint32
+}
+
+// GroupEntry is a system group entry
+type GroupEntry struct {
+	GID     uint32
+	Members []string
+	Name    string
+}
+
+// ShadowEntry is a system user password lock and expiration state
+type ShadowEntry struct {
+	// Expires is the account expiration date, zero if it never expires
+	Expires time.Time
+	Locked  bool
+	Name    string
+}
+
+// Backend manages system users and groups databases.
+// Lookups of unexistent entries return os/user UnknownUserError or UnknownGroupError.
+type Backend interface {
+	// AddGroup creates a group, it is a noop if the group already exists
+	AddGroup(name string, gid uint32) error
+	// AddGroupMember adds an user to a group supplementary members
+	AddGroupMember(group, username string) error
+	// AddUser creates an user, its private group with the same id as the user, its home directory and supplementary groups memberships
+	AddUser(account *Account) error
+	// DeleteUser removes an user, its private group, group memberships and home directory
+	DeleteUser(username string) error
+	// IDInUse checks whether an id is used by any user or group
+	IDInUse(id uint32) bool
+	// LockUser disables an user login, both password and SSH keys
+	LockUser(username string) error
+	// LookupGroup retrieves a group entry
+	LookupGroup(name string) (*GroupEntry, error)
+	// LookupShadow retrieves an user password lock and expiration state
+	LookupShadow(username string) (*ShadowEntry, error)
+	// LookupUser retrieves an user account entry
+	LookupUser(username string) (*Account, error)
+	// RemoveGroupMember removes an user from a group supplementary members
+	RemoveGroupMember(group, username string) error
+	// SetExpiry sets an user account expiration date, the zero time clears it
+	SetExpiry(username string, expires time.Time) error
+	// SetShell changes an user login shell
+	SetShell(username, shell string) error
+	// UnlockUser reverts LockUser
+	UnlockUser(username string) error
+}
+
+// System is the Backend managing the host users and groups
+var System Backend = &ShadowUtils{}
+
+// parseShadowEntry parses the fields of a shadow line
+func parseShadowEntry(fields []string) (*ShadowEntry, error) {
+	if len(fields) != 9 {
+		return nil, fmt.Errorf("unexpected shadow entry for user %q", fields[0])
+	}
+	entry := &ShadowEntry{
+		Locked: strings.HasPrefix(fields[1], "!"),
+		Name:   fields[0],
+	}
+	if fields[7] != "" {
+		days, err := strconv.ParseInt(fields[7], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration %q for user %q: %s", fields[7], fields[0], err)
+		}
+		entry.Expires = time.Unix(days*86400, 0).UTC()
+	}
+	return entry, nil
+}
+
+// expiryDays formats an expiration date as days since the epoch, the shadow format
+func expiryDays(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(expires.Unix()/86400, 10)
+}
@@ -0,0 +1,239 @@
+package user
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// DefaultWorkers is the default number of concurrent AWS IAM calls when fetching users
+const DefaultWorkers = 8
+
+// throttleBaseDelay is the first delay before retrying a throttled call
+var throttleBaseDelay = 200 * time.Millisecond
+
+// throttlingCodes are AWS error codes of throttled calls
+var throttlingCodes = []string{"Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException"}
+
+// RateLimiter is a token bucket allowing Rate calls per second on average,
+// with bursts of up to Burst calls. A nil RateLimiter never limits.
+type RateLimiter struct {
+	burst  float64
+	last   time.Time
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+}
+
+// NewRateLimiter instantiates a RateLimiter with a full bucket, a rate
+// lower or equal to zero disables it
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{burst: float64(burst), last: time.Now(), rate: rate, tokens: float64(burst)}
+}
+
+// Wait blocks until a call is allowed
+func (l *RateLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// take the token right away, callers wait for it in line
+	l.tokens--
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	time.Sleep(wait)
+}
+
+// IAMClient wraps an IAM service, rate limiting calls and retrying throttled
+// and transient failures with exponential backoff. Clients of several AWS
+// accounts may share the same RateLimiter. The wrapped service retries
+// must be disabled, e.g. with aws.Config MaxRetries set to 0, so every
+// attempt goes through the RateLimiter.
+type IAMClient struct {
+	Limiter *RateLimiter
+	// MaxRetries is the number of retries of throttled and transient failures
+	MaxRetries int
+	// Observe is called with the operation and result of every call, e.g. for metrics
+	Observe func(operation string, err error)
+	svc     IAM
+}
+
+// NewIAMClient instantiates an IAMClient for the given IAM service
+func NewIAMClient(svc IAM, limiter *RateLimiter) *IAMClient {
+	return &IAMClient{Limiter: limiter, MaxRetries: 5, svc: svc}
+}
+
+// call runs an operation, retrying it while throttled or failing transiently
+func (c *IAMClient) call(operation string, fn func() error) error {
+	delay := throttleBaseDelay
+	for retries := 0; ; retries++ {
+		c.Limiter.Wait()
+		err := fn()
+		if c.Observe != nil {
+			c.Observe(operation, err)
+		}
+		if err == nil || !retryable(err) || retries >= c.MaxRetries {
+			return err
+		}
+		// equal jitter, between half and the full delay
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		delay *= 2
+	}
+}
+
+// retryable checks wether an AWS call failure is worth retrying
+func retryable(err error) bool {
+	return throttled(err) || request.IsErrorRetryable(err)
+}
+
+// throttled checks wether an AWS call failed due to throttling
+func throttled(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && stringIn(aerr.Code(), throttlingCodes)
+}
+
+// GetAccessKeyLastUsed calls IAM GetAccessKeyLastUsed under the rate limiter
+func (c *IAMClient) GetAccessKeyLastUsed(input *iam.GetAccessKeyLastUsedInput) (out *iam.GetAccessKeyLastUsedOutput, err error) {
+	err = c.call("GetAccessKeyLastUsed", func() error {
+		out, err = c.svc.GetAccessKeyLastUsed(input)
+		return err
+	})
+	return out, err
+}
+
+// GetGroup calls IAM GetGroup under the rate limiter
+func (c *IAMClient) GetGroup(input *iam.GetGroupInput) (out *iam.GetGroupOutput, err error) {
+	err = c.call("GetGroup", func() error {
+		out, err = c.svc.GetGroup(input)
+		return err
+	})
+	return out, err
+}
+
+// GetSSHPublicKey calls IAM GetSSHPublicKey under the rate limiter
+func (c *IAMClient) GetSSHPublicKey(input *iam.GetSSHPublicKeyInput) (out *iam.GetSSHPublicKeyOutput, err error) {
+	err = c.call("GetSSHPublicKey", func() error {
+		out, err = c.svc.GetSSHPublicKey(input)
+		return err
+	})
+	return out, err
+}
+
+// GetUser calls IAM GetUser under the rate limiter
+func (c *IAMClient) GetUser(input *iam.GetUserInput) (out *iam.GetUserOutput, err error) {
+	err = c.call("GetUser", func() error {
+		out, err = c.svc.GetUser(input)
+		return err
+	})
+	return out, err
+}
+
+// ListAccessKeys calls IAM ListAccessKeys under the rate limiter
+func (c *IAMClient) ListAccessKeys(input *iam.ListAccessKeysInput) (out *iam.ListAccessKeysOutput, err error) {
+	err = c.call("ListAccessKeys", func() error {
+		out, err = c.svc.ListAccessKeys(input)
+		return err
+	})
+	return out, err
+}
+
+// ListGroupsForUser calls IAM ListGroupsForUser under the rate limiter
+func (c *IAMClient) ListGroupsForUser(input *iam.ListGroupsForUserInput) (out *iam.ListGroupsForUserOutput, err error) {
+	err = c.call("ListGroupsForUser", func() error {
+		out, err = c.svc.ListGroupsForUser(input)
+		return err
+	})
+	return out, err
+}
+
+// ListSSHPublicKeys calls IAM ListSSHPublicKeys under the rate limiter
+func (c *IAMClient) ListSSHPublicKeys(input *iam.ListSSHPublicKeysInput) (out *iam.ListSSHPublicKeysOutput, err error) {
+	err = c.call("ListSSHPublicKeys", func() error {
+		out, err = c.svc.ListSSHPublicKeys(input)
+		return err
+	})
+	return out, err
+}
+
+// ListUserTags calls IAM ListUserTags under the rate limiter
+func (c *IAMClient) ListUserTags(input *iam.ListUserTagsInput) (out *iam.ListUserTagsOutput, err error) {
+	err = c.call("ListUserTags", func() error {
+		out, err = c.svc.ListUserTags(input)
+		return err
+	})
+	return out, err
+}
+
+// ListUsers calls IAM ListUsers under the rate limiter
+func (c *IAMClient) ListUsers(input *iam.ListUsersInput) (out *iam.ListUsersOutput, err error) {
+	err = c.call("ListUsers", func() error {
+		out, err = c.svc.ListUsers(input)
+		return err
+	})
+	return out, err
+}
+
+// concurrentDirectory is implemented by directories allowing concurrent calls
+type concurrentDirectory interface {
+	// ConcurrentCalls returns the number of concurrent calls allowed
+	ConcurrentCalls() int
+}
+
+// directoryWorkers returns the number of concurrent calls a directory allows, 1 unless it tells otherwise
+func directoryWorkers(dir Directory) int {
+	if d, ok := dir.(concurrentDirectory); ok {
+		return d.ConcurrentCalls()
+	}
+	return 1
+}
+
+// parallel runs fn for every index in [0, n) on up to workers goroutines,
+// returning the first error
+func parallel(workers, n int, fn func(i int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	indexes := make(chan int)
+	errs := make(chan error, n)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// throttledIAM fails GetUser calls with the given errors before succeeding
+type throttledIAM struct {
+	*fakeIAM
+	errs []error
+}
+
+func (t *throttledIAM) GetUser(input *iam.GetUserInput) (*iam.GetUserOutput, error) {
+	t.count("GetUser")
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return nil, err
+	}
+	return &iam.GetUserOutput{User: &iam.User{UserName: input.UserName}}, nil
+}
+
+func TestIAMClientRetriesThrottledCalls(t *testing.T) {
+	defer func(d time.Duration) { throttleBaseDelay = d }(throttleBaseDelay)
+	throttleBaseDelay = time.Millisecond
+	svc := &throttledIAM{fakeIAM: newFakeIAM(10), errs: []error{
+		awserr.New("Throttling", "Rate exceeded", nil),
+		awserr.New("Throttling", "Rate exceeded", nil),
+	}}
+	observed := []string{}
+	client := NewIAMClient(svc, nil)
+	client.Observe = func(operation string, err error) {
+		observed = append(observed, fmt.Sprintf("%s %v", operation, err != nil))
+	}
+	out, err := client.GetUser(&iam.GetUserInput{UserName: aws.String("rochacon")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(out.User.UserName) != "rochacon" || svc.calls["GetUser"] != 3 {
+		t.Errorf("expected 3 GetUser calls, got %d", svc.calls["GetUser"])
+	}
+	if len(observed) != 3 || observed[2] != "GetUser false" {
+		t.Errorf("unexpected observed calls %#v", observed)
+	}
+
+	svc.errs = []error{awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil)}
+	if _, err = client.GetUser(&iam.GetUserInput{UserName: aws.String("rochacon")}); err == nil {
+		t.Errorf("expected error")
+	}
+	if svc.calls["GetUser"] != 4 {
+		t.Errorf("expected other errors not to be retried, got %d GetUser calls", svc.calls["GetUser"])
+	}
+
+	client.MaxRetries = 1
+	svc.errs = []error{awserr.New("Throttling", "Rate exceeded", nil), awserr.New("Throttling", "Rate exceeded", nil)}
+	if _, err = client.GetUser(&iam.GetUserInput{UserName: aws.String("rochacon")}); !throttled(err) {
+		t.Errorf("expected throttling error after retries, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(0, 10) != nil {
+		t.Errorf("expected zero rate to disable the limiter")
+	}
+	limiter := NewRateLimiter(100, 2)
+	started := time.Now()
+	for i := 0; i < 6; i++ {
+		limiter.Wait()
+	}
+	// 2 calls on the burst, 4 more at 10ms each
+	if elapsed := time.Since(started); elapsed < 35*time.Millisecond {
+		t.Errorf("expected calls to be limited, took %s", elapsed)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	var calls int32
+	err := parallel(DefaultWorkers, 20, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 7 {
+			return fmt.Errorf("failed %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "failed 7" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if calls != 20 {
+		t.Errorf("expected 20 calls, got %d", calls)
+	}
+	if err = parallel(DefaultWorkers, 0, func(i int) error { return fmt.Errorf("unexpected call") }); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,155 @@
+package user
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultArchiveDir is where removed users home directories are archived
+const DefaultArchiveDir = "/var/lib/bastrd/archive"
+
+// Removal tracks a staged user removal
+type Removal struct {
+	Archive string    `json:"archive"`
+	Since   time.Time `json:"since"`
+}
+
+// Lock disables the user logins
+func (u *User) Lock() error {
+	if err := ensureManaged(u.Username); err != nil {
+		return err
+	}
+	err := System.LockUser(u.Username)
+	if err != nil {
+		return fmt.Errorf("failed to lock user %q: %s", u.Username, err)
+	}
+	return nil
+}
+
+// Unlock enables the user logins
+func (u *User) Unlock() error {
+	err := System.UnlockUser(u.Username)
+	if err != nil {
+		return fmt.Errorf("failed to unlock user %q: %s", u.Username, err)
+	}
+	return nil
+}
+
+// Terminate kills the user toolbox container and processes
+func (u *User) Terminate() error {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("/usr/bin/docker", "container", "rm", "--force", u.Username)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil && !strings.Contains(stderr.String(), "No such container") {
+		return fmt.Errorf("failed to remove user %q toolbox container: %s %q", u.Username, err, strings.TrimSpace(stderr.String()))
+	}
+	stderr.Reset()
+	cmd = exec.Command("pkill", "--signal", "KILL", "--uid", u.Username)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		// pkill exits with 1 when no processes matched
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			return fmt.Errorf("failed to kill user %q processes: %s %q", u.Username, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	return nil
+}
+
+// Archive writes the user home directory, under the filesystem root, to a
+// gzipped tarball in dir, returning the tarball path. A missing home
+// directory is archived as an empty tarball.
+func (u *User) Archive(dir, root string) (string, error) {
+	account, err := System.LookupUser(u.Username)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve user %q details: %s", u.Username, err)
+	}
+	if account.Home == "" {
+		account.Home = u.HomeDir()
+	}
+	home := filepath.Join(root, account.Home)
+	if _, err = os.Lstat(home); os.IsNotExist(err) {
+		log.Printf("User %q home directory %q doesn't exist, nothing to archive", u.Username, home)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("%s-%s.tar.gz", u.Username, time.Now().UTC().Format("20060102T150405Z")))
+	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = archiveDir(fp, home, u.Username)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return "", fmt.Errorf("failed to archive user %q home directory: %s", u.Username, err)
+	}
+	return filename, nil
+}
+
+// archiveDir writes a gzipped tarball of root to w, with entries prefixed
+// by name, empty if root doesn't exist
+func archiveDir(w io.Writer, root, name string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			// skip sockets, pipes and devices
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(name, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		fp, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = io.Copy(tw, fp)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,106 @@
+package user
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestArchiveDir(t *testing.T) {
+	home, err := ioutil.TempDir("", "bastrd-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	os.MkdirAll(filepath.Join(home, "data"), 0750)
+	ioutil.WriteFile(filepath.Join(home, "data", "notes.txt"), []byte("important"), 0600)
+	os.Symlink("data/notes.txt", filepath.Join(home, "notes"))
+
+	buf := &bytes.Buffer{}
+	if err = archiveDir(buf, home, "rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	names := []string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "rochacon/data/notes.txt" {
+			content, _ := ioutil.ReadAll(tr)
+			if string(content) != "important" {
+				t.Errorf("unexpected archived content %q", content)
+			}
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"rochacon/", "rochacon/data/", "rochacon/data/notes.txt", "rochacon/notes"}
+	if len(names) != len(expected) {
+		t.Fatalf("unexpected archive entries %q", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("unexpected archive entries %q, expected %q", names, expected)
+			break
+		}
+	}
+}
+
+func TestArchiveUnderRoot(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	archives, err := ioutil.TempDir("", "bastrd-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archives)
+	u := &User{IAMUsername: "rochacon", UID: 2000, Username: "rochacon"}
+	if err = u.Ensure(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, remove := range []bool{false, true} {
+		if remove {
+			if err = os.RemoveAll(filepath.Join(f.Root, "home", "rochacon")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path, err := u.Archive(filepath.Join(archives, fmt.Sprint(remove)), f.Root)
+		if err != nil {
+			t.Fatalf("unexpected error archiving (home removed %t): %s", remove, err)
+		}
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tar.NewReader(gz).Next()
+		if remove && err != io.EOF {
+			t.Errorf("expected an empty archive of a missing home directory, got %#v, %v", hdr, err)
+		}
+		if !remove && (err != nil || hdr.Name != "rochacon/") {
+			t.Errorf("expected the home directory under the root to be archived, got %#v, %v", hdr, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package user
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH public key statuses, matching AWS IAM status types
+const (
+	KeyStatusActive   = "Active"
+	KeyStatusInactive = "Inactive"
+)
+
+// Directory is an identity source providing users, groups and SSH public keys
+type Directory interface {
+	// GroupMembers lists the users belonging to a group, failing with
+	// os/user.UnknownGroupError if the group doesn't exist
+	GroupMembers(group string) ([]*Identity, error)
+	// SSHPublicKeys lists an user SSH public keys, inactive keys may have an empty body
+	SSHPublicKeys(username string) ([]*SSHPublicKey, error)
+	// User retrieves an user, or nil if it doesn't exist
+	User(username string) (*Identity, error)
+	// UserActivity retrieves an user credentials state and usage, access
+	// keys usage only counts towards LastUsed if lastUsed is set
+	UserActivity(username string, lastUsed bool) (*Activity, error)
+	// UserGroups lists the names of the groups an user belongs to
+	UserGroups(username string) ([]string, error)
+	// UserTags retrieves an user tags
+	UserTags(username string) (map[string]string, error)
+	// ListUsers lists the users under a path prefix, e.g. "/engineering/"
+	ListUsers(pathPrefix string) ([]*Identity, error)
+}
+
+// Identity is an user as known by a Directory
+type Identity struct {
+	ID       string `json:"id,omitempty" yaml:"id,omitempty"`
+	Path     string `json:"path,omitempty" yaml:"path,omitempty"`
+	Username string `json:"username" yaml:"username"`
+}
+
+// Activity is an user credentials state and usage, as known by a Directory
+type Activity struct {
+	// AccessKeys is the number of access keys, ActiveAccessKeys the active ones
+	AccessKeys       int `json:"access_keys" yaml:"access_keys"`
+	ActiveAccessKeys int `json:"active_access_keys" yaml:"active_access_keys"`
+	// Created is when the user was created, if known
+	Created time.Time `json:"created" yaml:"created"`
+	// LastUsed is the latest password or access key usage, zero if never used
+	LastUsed time.Time `json:"last_used" yaml:"last_used"`
+}
+
+// SSHPublicKey is an user SSH public key registered on a Directory
+type SSHPublicKey struct {
+	Body       string    `json:"body"`
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	UploadDate time.Time `json:"upload_date"`
+}
+
+// Active checks wether the key is active
+func (k *SSHPublicKey) Active() bool {
+	return k.Status == KeyStatusActive
+}
+
+// Fingerprint returns the key SHA256 fingerprint, as shown by ssh-keygen -l
+func (k *SSHPublicKey) Fingerprint() (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Body))
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(key), nil
+}
+
+// Matches checks wether the key has the fingerprint, SHA256 or MD5 as given
+// by sshd %f, and type, e.g. ssh-ed25519 as given by sshd %t. An empty key
+// type matches any type.
+func (k *SSHPublicKey) Matches(fingerprint, keyType string) bool {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Body))
+	if err != nil {
+		return false
+	}
+	if keyType != "" && key.Type() != keyType {
+		return false
+	}
+	if strings.HasPrefix(fingerprint, "MD5:") {
+		return strings.TrimPrefix(fingerprint, "MD5:") == ssh.FingerprintLegacyMD5(key)
+	}
+	return fingerprint == ssh.FingerprintSHA256(key)
+}
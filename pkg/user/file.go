@@ -0,0 +1,175 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	osuser "os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileDirectory is a static Directory loaded from a YAML or JSON file, e.g.:
+//
+//	groups:
+//	  bastrd: [rochacon]
+//	users:
+//	  rochacon:
+//	    activity:
+//	      last_used: 2019-01-02T15:04:05Z
+//	    path: /engineering/
+//	    tags:
+//	      bastrd:sandbox: "false"
+//	    ssh_public_keys:
+//	      - ssh-ed25519 AAAA...
+type FileDirectory struct {
+	Groups map[string][]string           `json:"groups" yaml:"groups"`
+	Users  map[string]*FileDirectoryUser `json:"users" yaml:"users"`
+}
+
+// FileDirectoryUser holds an user's FileDirectory entry
+type FileDirectoryUser struct {
+	// Activity is the user credentials state and usage, unknown by default
+	Activity *Activity `json:"activity" yaml:"activity"`
+	ID       string    `json:"id" yaml:"id"`
+	// Path is the user path, defaults to "/"
+	Path          string            `json:"path" yaml:"path"`
+	SSHPublicKeys []string          `json:"ssh_public_keys" yaml:"ssh_public_keys"`
+	Tags          map[string]string `json:"tags" yaml:"tags"`
+}
+
+// LoadFileDirectory reads a FileDirectory, files ending in .yml or .yaml are parsed as YAML, others as JSON
+func LoadFileDirectory(path string) (*FileDirectory, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &FileDirectory{}
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(content, d)
+	default:
+		err = json.Unmarshal(content, d)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse directory file %q: %s", path, err)
+	}
+	return d, nil
+}
+
+// GroupMembers lists the users belonging to a group
+func (d *FileDirectory) GroupMembers(group string) ([]*Identity, error) {
+	identities := []*Identity{}
+	members, ok := d.Groups[group]
+	if !ok {
+		return identities, osuser.UnknownGroupError(group)
+	}
+	for _, username := range members {
+		identities = append(identities, d.identity(username))
+	}
+	return identities, nil
+}
+
+// SSHPublicKeys lists an user SSH public keys, all keys in a file are active
+func (d *FileDirectory) SSHPublicKeys(username string) ([]*SSHPublicKey, error) {
+	keys := []*SSHPublicKey{}
+	u, ok := d.Users[username]
+	if !ok || u == nil {
+		return keys, nil
+	}
+	for i, body := range u.SSHPublicKeys {
+		keys = append(keys, &SSHPublicKey{
+			Body:   body,
+			ID:     fmt.Sprintf("%s-%d", username, i),
+			Status: KeyStatusActive,
+		})
+	}
+	return keys, nil
+}
+
+// User retrieves an user, or nil if it isn't in any group nor users entry
+func (d *FileDirectory) User(username string) (*Identity, error) {
+	if !stringIn(username, d.usernames()) {
+		return nil, nil
+	}
+	return d.identity(username), nil
+}
+
+// UserActivity retrieves an user credentials state and usage
+func (d *FileDirectory) UserActivity(username string, lastUsed bool) (*Activity, error) {
+	activity := &Activity{}
+	if u, ok := d.Users[username]; ok && u != nil && u.Activity != nil {
+		*activity = *u.Activity
+	}
+	return activity, nil
+}
+
+// UserGroups lists the names of the groups an user belongs to
+func (d *FileDirectory) UserGroups(username string) ([]string, error) {
+	groups := []string{}
+	for group, members := range d.Groups {
+		for _, member := range members {
+			if member == username {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// UserTags retrieves an user tags
+func (d *FileDirectory) UserTags(username string) (map[string]string, error) {
+	tags := map[string]string{}
+	if u, ok := d.Users[username]; ok && u != nil {
+		for k, v := range u.Tags {
+			tags[k] = v
+		}
+	}
+	return tags, nil
+}
+
+// ListUsers lists the users under a path prefix
+func (d *FileDirectory) ListUsers(pathPrefix string) ([]*Identity, error) {
+	identities := []*Identity{}
+	for _, username := range d.usernames() {
+		identity := d.identity(username)
+		if strings.HasPrefix(identity.Path, pathPrefix) {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+// identity returns an user Identity, with its path defaulting to "/"
+func (d *FileDirectory) identity(username string) *Identity {
+	identity := &Identity{Path: "/", Username: username}
+	if u, ok := d.Users[username]; ok && u != nil {
+		identity.ID = u.ID
+		if u.Path != "" {
+			identity.Path = u.Path
+		}
+	}
+	return identity
+}
+
+// usernames lists the sorted names of the users found on groups and users entries
+func (d *FileDirectory) usernames() []string {
+	usernames := []string{}
+	for username := range d.Users {
+		usernames = append(usernames, username)
+	}
+	for _, members := range d.Groups {
+		for _, username := range members {
+			if !stringIn(username, usernames) {
+				usernames = append(usernames, username)
+			}
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestFileDirectoryYAML(t *testing.T) {
+	path, cleanup := writeTempFile(t, "directory.yml", `
+groups:
+  bastrd: [rochacon, root]
+  admins: [rochacon]
+users:
+  rochacon:
+    id: AIDAEXAMPLE
+    ssh_public_keys:
+      - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample rochacon
+`)
+	defer cleanup()
+	dir, err := LoadFileDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := FromDirectory(dir, &Group{Name: "bastrd"}, &Group{Name: "admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "rochacon" || len(users[0].Groups) != 2 {
+		t.Errorf("unexpected users from file directory: %#v", users)
+	}
+	groups, err := dir.UserGroups("rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0] != "admins" || groups[1] != "bastrd" {
+		t.Errorf("unexpected user groups: %#v", groups)
+	}
+	keys, err := dir.SSHPublicKeys("rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Active() {
+		t.Errorf("unexpected user keys: %#v", keys)
+	}
+}
+
+func TestFileDirectoryJSON(t *testing.T) {
+	path, cleanup := writeTempFile(t, "directory.json", `{"groups": {"bastrd": ["rochacon"]}}`)
+	defer cleanup()
+	dir, err := LoadFileDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := dir.GroupMembers("bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Username != "rochacon" {
+		t.Errorf("unexpected group members: %#v", members)
+	}
+	if _, err = dir.GroupMembers("missing"); err == nil {
+		t.Errorf("expected error for missing group")
+	}
+}
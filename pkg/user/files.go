@@ -0,0 +1,591 @@
+package user
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockTimeout is how long Files waits for the databases locks
+var lockTimeout = 15 * time.Second
+
+// Files is a Backend editing /etc/passwd, /etc/shadow, /etc/group and
+// /etc/gshadow directly. Changes are written atomically while holding the
+// same /etc/.pwd.lock and .lock files used by shadow-utils.
+type Files struct {
+	// Root is the filesystem root holding etc and home, defaults to /
+	Root string
+}
+
+// AddGroup creates a group, it is a noop if the group already exists
+func (f *Files) AddGroup(name string, gid uint32) error {
+	return f.update(func(db *filesDB) error {
+		if db.group.find(name) != nil {
+			return nil
+		}
+		if gid == 0 || db.idInUse(gid) {
+			gid = db.nextID()
+		}
+		db.group.add([]string{name, "x", strconv.FormatUint(uint64(gid), 10), ""})
+		db.gshadow.add([]string{name, "!", "", ""})
+		return nil
+	})
+}
+
+// AddGroupMember adds an user to a group supplementary members
+func (f *Files) AddGroupMember(group, username string) error {
+	return f.update(func(db *filesDB) error {
+		if db.passwd.find(username) == nil {
+			return osuser.UnknownUserError(username)
+		}
+		return db.addMember(group, username)
+	})
+}
+
+// AddUser creates an user, its private group, home directory and supplementary groups memberships
+func (f *Files) AddUser(account *Account) error {
+	home := account.Home
+	if home == "" {
+		home = filepath.Join("/home", account.Name)
+	}
+	err := f.update(func(db *filesDB) error {
+		if db.passwd.find(account.Name) != nil {
+			return fmt.Errorf("user %q already exists", account.Name)
+		}
+		if db.group.find(account.Name) != nil {
+			return fmt.Errorf("group %q already exists", account.Name)
+		}
+		if db.idInUse(account.UID) {
+			return fmt.Errorf("id %d already in use", account.UID)
+		}
+		for _, group := range account.Groups {
+			if db.group.find(group) == nil {
+				return osuser.UnknownGroupError(group)
+			}
+		}
+		id := strconv.FormatUint(uint64(account.UID), 10)
+		db.passwd.add([]string{account.Name, "x", id, id, account.Gecos, home, account.Shell})
+		db.shadow.add([]string{account.Name, "*", strconv.FormatInt(time.Now().Unix()/86400, 10), "0", "99999", "7", "", "", ""})
+		db.group.add([]string{account.Name, "x", id, ""})
+		db.gshadow.add([]string{account.Name, "!", "", ""})
+		for _, group := range account.Groups {
+			if err := db.addMember(group, account.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.createHome(filepath.Join(f.root(), home), int(account.UID))
+}
+
+// DeleteUser removes an user, its private group, group memberships and home directory
+func (f *Files) DeleteUser(username string) error {
+	home := ""
+	err := f.update(func(db *filesDB) error {
+		entry := db.passwd.find(username)
+		if entry == nil {
+			return osuser.UnknownUserError(username)
+		}
+		home = entry[5]
+		db.passwd.remove(username)
+		db.shadow.remove(username)
+		if group := db.group.find(username); group != nil && group[2] == entry[3] && group[3] == "" {
+			db.group.remove(username)
+			db.gshadow.remove(username)
+		}
+		for _, group := range db.group.entries() {
+			db.removeMember(group[0], username)
+		}
+		return nil
+	})
+	if err != nil || home == "" || home == "/" {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(f.root(), home))
+}
+
+// IDInUse checks whether an id is used by any user or group
+func (f *Files) IDInUse(id uint32) bool {
+	db, err := f.load()
+	if err != nil {
+		return true
+	}
+	return db.idInUse(id)
+}
+
+// LockUser locks the user password and expires the account, so SSH public key logins are denied too
+func (f *Files) LockUser(username string) error {
+	return f.update(func(db *filesDB) error {
+		entry := db.shadow.find(username)
+		if entry == nil || len(entry) != 9 {
+			return osuser.UnknownUserError(username)
+		}
+		if !strings.HasPrefix(entry[1], "!") {
+			entry[1] = "!" + entry[1]
+		}
+		entry[7] = "1"
+		return nil
+	})
+}
+
+// LookupGroup retrieves a group entry
+func (f *Files) LookupGroup(name string) (*GroupEntry, error) {
+	db, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	fields := db.group.find(name)
+	if fields == nil {
+		return nil, osuser.UnknownGroupError(name)
+	}
+	return parseGroupEntry(fields)
+}
+
+// LookupShadow retrieves an user password lock and expiration state
+func (f *Files) LookupShadow(username string) (*ShadowEntry, error) {
+	db, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	fields := db.shadow.find(username)
+	if fields == nil {
+		return nil, osuser.UnknownUserError(username)
+	}
+	return parseShadowEntry(fields)
+}
+
+// LookupUser retrieves an user account entry
+func (f *Files) LookupUser(username string) (*Account, error) {
+	db, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	fields := db.passwd.find(username)
+	if fields == nil {
+		return nil, osuser.UnknownUserError(username)
+	}
+	return parsePasswdEntry(fields)
+}
+
+// RemoveGroupMember removes an user from a group supplementary members
+func (f *Files) RemoveGroupMember(group, username string) error {
+	return f.update(func(db *filesDB) error {
+		if db.group.find(group) == nil {
+			return osuser.UnknownGroupError(group)
+		}
+		db.removeMember(group, username)
+		return nil
+	})
+}
+
+// SetExpiry sets an user account expiration date, the zero time clears it
+func (f *Files) SetExpiry(username string, expires time.Time) error {
+	return f.update(func(db *filesDB) error {
+		entry := db.shadow.find(username)
+		if entry == nil || len(entry) != 9 {
+			return osuser.UnknownUserError(username)
+		}
+		entry[7] = expiryDays(expires)
+		return nil
+	})
+}
+
+// SetShell changes an user login shell
+func (f *Files) SetShell(username, shell string) error {
+	return f.update(func(db *filesDB) error {
+		entry := db.passwd.find(username)
+		if entry == nil {
+			return osuser.UnknownUserError(username)
+		}
+		entry[6] = shell
+		return nil
+	})
+}
+
+// UnlockUser unlocks the user password and clears the account expiration
+func (f *Files) UnlockUser(username string) error {
+	return f.update(func(db *filesDB) error {
+		entry := db.shadow.find(username)
+		if entry == nil || len(entry) != 9 {
+			return osuser.UnknownUserError(username)
+		}
+		entry[1] = strings.TrimPrefix(entry[1], "!")
+		entry[7] = ""
+		return nil
+	})
+}
+
+// root returns the filesystem root
+func (f *Files) root() string {
+	if f.Root == "" {
+		return "/"
+	}
+	return f.Root
+}
+
+// path returns the path of a database file
+func (f *Files) path(name string) string {
+	return filepath.Join(f.root(), "etc", name)
+}
+
+// load reads all databases without locking, for lookups
+func (f *Files) load() (*filesDB, error) {
+	db := &filesDB{}
+	var err error
+	for _, t := range []struct {
+		table  **filesTable
+		name   string
+		fields int
+	}{{&db.passwd, "passwd", 7}, {&db.shadow, "shadow", 9}, {&db.group, "group", 4}, {&db.gshadow, "gshadow", 4}} {
+		*t.table, err = readTable(f.path(t.name), t.fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// update locks and loads the databases, applies fn and writes the changed databases back atomically
+func (f *Files) update(fn func(db *filesDB) error) error {
+	unlock, err := lockPasswd(f.path(".pwd.lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, name := range []string{"passwd", "shadow", "group", "gshadow"} {
+		unlock, err := lockFile(f.path(name))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	db, err := f.load()
+	if err != nil {
+		return err
+	}
+	if err = fn(db); err != nil {
+		return err
+	}
+	for _, table := range []*filesTable{db.passwd, db.shadow, db.group, db.gshadow} {
+		if err = table.write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createHome creates an user home directory, copying /etc/skel contents if present
+func (f *Files) createHome(home string, id int) error {
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return err
+	}
+	skel := f.path("skel")
+	err := filepath.Walk(skel, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(skel, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(home, rel)
+		if info.IsDir() {
+			err = os.MkdirAll(target, info.Mode().Perm())
+		} else if info.Mode().IsRegular() {
+			err = copyFile(path, target, info.Mode().Perm())
+		} else {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return chown(target, id)
+	})
+	if err != nil {
+		return err
+	}
+	return chown(home, id)
+}
+
+// chown sets a path owner and group when running as root
+func chown(path string, id int) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, id, id)
+}
+
+// copyFile copies a regular file contents
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// lockFile acquires a shadow-utils compatible lock on a database, i.e. an
+// exclusively created path.lock file holding the owner pid. Locks held by
+// dead processes are broken.
+func lockFile(path string) (func(), error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		fp, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(fp, "%d", os.Getpid())
+			fp.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to lock %q: %s", path, err)
+		}
+		if staleLock(lock) {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %q", lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// lockPasswd acquires the shadow-utils global lock, i.e. a write lock on
+// /etc/.pwd.lock as taken by lckpwdf(3)
+func lockPasswd(path string) (func(), error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %q: %s", path, err)
+	}
+	lock := &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = syscall.FcntlFlock(fp.Fd(), syscall.F_SETLK, lock)
+		if err == nil {
+			return func() { fp.Close() }, nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			fp.Close()
+			return nil, fmt.Errorf("failed to lock %q: %s", path, err)
+		}
+		if time.Now().After(deadline) {
+			fp.Close()
+			return nil, fmt.Errorf("timed out waiting for lock %q", path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// staleLock checks whether the process owning a lock file is gone
+func staleLock(lock string) bool {
+	content, err := ioutil.ReadFile(lock)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
+
+// filesDB holds all the account databases
+type filesDB struct {
+	group   *filesTable
+	gshadow *filesTable
+	passwd  *filesTable
+	shadow  *filesTable
+}
+
+// idInUse checks whether an id is used by any user or group
+func (db *filesDB) idInUse(id uint32) bool {
+	sid := strconv.FormatUint(uint64(id), 10)
+	for _, entry := range db.passwd.entries() {
+		if entry[2] == sid {
+			return true
+		}
+	}
+	for _, entry := range db.group.entries() {
+		if entry[2] == sid {
+			return true
+		}
+	}
+	return false
+}
+
+// nextID returns the next free id after the highest regular id in use
+func (db *filesDB) nextID() uint32 {
+	next := uint32(1000)
+	for _, table := range []*filesTable{db.passwd, db.group} {
+		for _, entry := range table.entries() {
+			id, err := strconv.ParseUint(entry[2], 10, 32)
+			if err == nil && uint32(id) >= next && id < 65534 {
+				next = uint32(id) + 1
+			}
+		}
+	}
+	return next
+}
+
+// addMember adds an user to group and gshadow members
+func (db *filesDB) addMember(group, username string) error {
+	entry := db.group.find(group)
+	if entry == nil {
+		return osuser.UnknownGroupError(group)
+	}
+	members := splitMembers(entry[3])
+	if !stringIn(username, members) {
+		entry[3] = strings.Join(append(members, username), ",")
+	}
+	if entry = db.gshadow.find(group); entry != nil {
+		members = splitMembers(entry[3])
+		if !stringIn(username, members) {
+			entry[3] = strings.Join(append(members, username), ",")
+		}
+	}
+	return nil
+}
+
+// removeMember removes an user from group and gshadow members
+func (db *filesDB) removeMember(group, username string) {
+	for _, table := range []*filesTable{db.group, db.gshadow} {
+		entry := table.find(group)
+		if entry == nil {
+			continue
+		}
+		members := []string{}
+		for _, m := range splitMembers(entry[3]) {
+			if m != username {
+				members = append(members, m)
+			}
+		}
+		entry[3] = strings.Join(members, ",")
+	}
+}
+
+// filesTable is a colon separated database, e.g. /etc/passwd.
+// Lines without the table number of fields, e.g. NIS "+" lines, are kept
+// as they are but never matched nor changed.
+type filesTable struct {
+	exists bool
+	fields int
+	lines  [][]string
+	path   string
+}
+
+// readTable reads a database with entries of the given number of fields,
+// an unexistent file results in an empty table
+func readTable(path string, fields int) (*filesTable, error) {
+	t := &filesTable{fields: fields, path: path}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	t.exists = true
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		t.lines = append(t.lines, strings.Split(line, ":"))
+	}
+	return t, nil
+}
+
+// entries returns the well formed entries
+func (t *filesTable) entries() [][]string {
+	entries := [][]string{}
+	for _, line := range t.lines {
+		if len(line) == t.fields {
+			entries = append(entries, line)
+		}
+	}
+	return entries
+}
+
+// find returns the entry with the given name, or nil
+func (t *filesTable) find(name string) []string {
+	for _, entry := range t.entries() {
+		if entry[0] == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// add appends an entry, tables without a backing file are left untouched
+func (t *filesTable) add(entry []string) {
+	if !t.exists {
+		return
+	}
+	t.lines = append(t.lines, entry)
+}
+
+// remove deletes the entry with the given name
+func (t *filesTable) remove(name string) {
+	lines := [][]string{}
+	for _, line := range t.lines {
+		if len(line) != t.fields || line[0] != name {
+			lines = append(lines, line)
+		}
+	}
+	t.lines = lines
+}
+
+// write atomically replaces the database file, keeping its mode and ownership
+func (t *filesTable) write() error {
+	if !t.exists {
+		return nil
+	}
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, line := range t.lines {
+		lines = append(lines, strings.Join(line, ":"))
+	}
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	if err = writeFileAtomic(t.path, content, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		return os.Chown(t.path, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
+
+// stringIn matches if a string exist in a string slice
+func stringIn(s string, ss []string) bool {
+	for _, item := range ss {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFilesRoot creates a temporary root with minimal account databases
+func newFilesRoot(t *testing.T) (*Files, func()) {
+	root, err := ioutil.TempDir("", "bastrd-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"etc/passwd":       "root:x:0:0:root:/root:/bin/bash\n",
+		"etc/shadow":       "root:*:17000:0:99999:7:::\n",
+		"etc/group":        "root:x:0:\ndocker:x:999:\n",
+		"etc/gshadow":      "root:*::\ndocker:!::\n",
+		"etc/skel/.bashrc": "# bashrc\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Files{Root: root}, func() { os.RemoveAll(root) }
+}
+
+func readRootFile(t *testing.T, f *Files, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(f.Root, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestFilesBackendUserLifecycle(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	if err := f.AddGroup("bastrd", 2100); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddGroup("bastrd", 2200); err != nil {
+		t.Fatalf("AddGroup should be idempotent: %s", err)
+	}
+	err := f.AddUser(&Account{
+		Gecos:  "bastrd managed user",
+		Groups: []string{"docker"},
+		Home:   "/home/rochacon",
+		Name:   "rochacon",
+		Shell:  ToolboxShell,
+		UID:    2000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(readRootFile(t, f, "etc/passwd"), "rochacon:x:2000:2000:bastrd managed user:/home/rochacon:/opt/bin/bastrd-toolbox\n") {
+		t.Errorf("unexpected passwd:\n%s", readRootFile(t, f, "etc/passwd"))
+	}
+	if !strings.Contains(readRootFile(t, f, "etc/shadow"), "rochacon:*:") {
+		t.Errorf("unexpected shadow:\n%s", readRootFile(t, f, "etc/shadow"))
+	}
+	if readRootFile(t, f, "home/rochacon/.bashrc") != "# bashrc\n" {
+		t.Errorf("skel was not copied to home directory")
+	}
+	if err = f.AddGroupMember("bastrd", "rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	group, err := f.LookupGroup("bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.GID != 2100 || len(group.Members) != 1 || group.Members[0] != "rochacon" {
+		t.Errorf("unexpected group entry: %#v", group)
+	}
+	if err = f.SetShell("rochacon", HostShell); err != nil {
+		t.Fatal(err)
+	}
+	account, err := f.LookupUser("rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Shell != HostShell || account.UID != 2000 {
+		t.Errorf("unexpected account entry: %#v", account)
+	}
+	if err = f.RemoveGroupMember("docker", "rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(readRootFile(t, f, "etc/group"), "docker:x:999:\n") {
+		t.Errorf("user not removed from docker group:\n%s", readRootFile(t, f, "etc/group"))
+	}
+	if err = f.DeleteUser("rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(readRootFile(t, f, "etc/passwd")+readRootFile(t, f, "etc/group")+readRootFile(t, f, "etc/gshadow"), "rochacon") {
+		t.Errorf("user leftovers after deletion")
+	}
+	if _, err = os.Stat(filepath.Join(f.Root, "home/rochacon")); !os.IsNotExist(err) {
+		t.Errorf("home directory not removed: %v", err)
+	}
+}
+
+func TestFilesBackendSync(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	group := &Group{Name: "bastrd", GID: 2100}
+	if err := group.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Username: "rochacon", UID: 2000, Groups: []*Group{group}}
+	if err := u.Ensure([]string{"docker"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.EnsureUser(u); err != nil {
+		t.Fatal(err)
+	}
+	sysUsers, err := FromSystemGroups(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sysUsers) != 1 || sysUsers[0].Username != "rochacon" || sysUsers[0].Shell != ToolboxShell {
+		t.Errorf("unexpected system users: %#v", sysUsers)
+	}
+	if uid, err := (User{Username: "rochacon"}).Uid(); err != nil || uid != 2000 {
+		t.Errorf("unexpected uid %d: %v", uid, err)
+	}
+}
+
+func TestFilesBackendBreaksStaleLocks(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	// pid 0x7ffffffe is very unlikely to exist
+	if err := ioutil.WriteFile(f.path("passwd")+".lock", []byte("2147483646"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddGroup("bastrd", 0); err != nil {
+		t.Fatal(err)
+	}
+	group, err := f.LookupGroup("bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.GID != 1000 {
+		t.Errorf("expected first free gid 1000, got %d", group.GID)
+	}
+	if _, err = os.Stat(f.path("passwd") + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestFilesBackendLockUser(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	if err := f.AddUser(&Account{Name: "rochacon", Shell: ToolboxShell, UID: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.LockUser("rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	shadow := readRootFile(t, f, "etc/shadow")
+	if !strings.Contains(shadow, "rochacon:!*:") || !strings.Contains(shadow, ":1:\n") {
+		t.Errorf("user not locked:\n%s", shadow)
+	}
+	if err := f.UnlockUser("rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	shadow = readRootFile(t, f, "etc/shadow")
+	if !strings.Contains(shadow, "rochacon:*:") || !strings.Contains(shadow, ":99999:7:::\n") {
+		t.Errorf("user not unlocked:\n%s", shadow)
+	}
+}
+
+func TestFilesBackendKeepsMalformedLines(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(f.path("passwd"), []byte("root:x:0:0:root:/root:/bin/bash\n+\nbroken:x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.path("group"), []byte("root:x:0:\ndocker:x:999:\n+\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddUser(&Account{Groups: []string{"docker"}, Name: "rochacon", Shell: ToolboxShell, UID: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.IDInUse(2000) || f.IDInUse(2001) {
+		t.Errorf("unexpected ids in use")
+	}
+	if err := f.RemoveGroupMember("docker", "rochacon"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.LookupUser("broken"); err == nil {
+		t.Errorf("expected malformed entry to be ignored")
+	}
+	passwd := readRootFile(t, f, "etc/passwd")
+	if !strings.Contains(passwd, "\n+\nbroken:x\n") || !strings.Contains(passwd, "rochacon:x:2000:2000:") {
+		t.Errorf("unexpected passwd:\n%s", passwd)
+	}
+	if group := readRootFile(t, f, "etc/group"); !strings.Contains(group, "\n+\n") {
+		t.Errorf("malformed group line not kept:\n%s", group)
+	}
+}
@@ -2,43 +2,47 @@ package user
 
 import (
 	"fmt"
-	"os/exec"
 )
 
 // Group holds a user group metadata
 type Group struct {
-	Name string
+	GID  uint32 `json:"gid,omitempty"`
+	Name string `json:"name"`
 }
 
-// Ensure a group is configured in the system
+// Ensure a group is configured in the system, using the allocated GID if set
 func (g *Group) Ensure() error {
-	cmd := exec.Command("/usr/sbin/groupadd", "-f", g.Name)
-	err := cmd.Run()
+	err := System.AddGroup(g.Name, g.GID)
 	if err != nil {
-		out, _ := cmd.Output()
-		return fmt.Errorf("call to groupadd %q failed: %q %q", g.Name, err, out)
+		return fmt.Errorf("failed to add group %q: %s", g.Name, err)
 	}
 	return nil
 }
 
 // EnsureUser ensures an user is member of a system group
 func (g *Group) EnsureUser(user *User) error {
-	cmd := exec.Command("/usr/sbin/usermod", "-a", "-G", g.Name, user.Username)
-	err := cmd.Run()
+	err := System.AddGroupMember(g.Name, user.Username)
 	if err != nil {
-		out, _ := cmd.Output()
-		return fmt.Errorf("failed to add user %q to group %q: %q %q", user.Username, g.Name, err, out)
+		return fmt.Errorf("failed to add user %q to group %q: %s", user.Username, g.Name, err)
 	}
 	return nil
 }
 
 // RemoveUser removes an user from the group
 func (g *Group) RemoveUser(user *User) error {
-	cmd := exec.Command("gpasswd", "-d", user.Username, g.Name)
-	err := cmd.Run()
+	err := System.RemoveGroupMember(g.Name, user.Username)
 	if err != nil {
-		out, _ := cmd.Output()
-		return fmt.Errorf("failed to remove user %q from group %q: %q %q", user.Username, g.Name, err, out)
+		return fmt.Errorf("failed to remove user %q from group %q: %s", user.Username, g.Name, err)
 	}
 	return nil
 }
+
+// groupIn checks wether a Group exists in a Group slice
+func groupIn(group *Group, groups []*Group) bool {
+	for _, g := range groups {
+		if group.Name == g.Name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+package user
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+// HomeTemplate renders a template directory into users home directories.
+// Files on Dir/default apply to every user and files on Dir/groups/<name>
+// to the group members, overriding the default ones. Files ending in .tmpl
+// are rendered as Go templates of HomeData, without the suffix, others are
+// copied as is.
+type HomeTemplate struct {
+	Dir string
+	// Region is the AWS region available to templates
+	Region string
+	// Root is the filesystem root holding the home directories
+	Root string
+}
+
+// HomeData holds the fields available to home templates, e.g. {{.Username}}
+type HomeData struct {
+	Groups      []string
+	Home        string
+	IAMUsername string
+	Region      string
+	Tags        map[string]string
+	UID         uint32
+	Username    string
+}
+
+// homeTemplateFuncs are the functions available to home templates
+var homeTemplateFuncs = template.FuncMap{
+	// split splits space or comma separated values, e.g. tags
+	"split": func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	},
+}
+
+// Provision renders the templates into a newly created user home
+// directory, overwriting existing files, e.g. the ones copied from
+// /etc/skel. checksums is filled with the written files checksums.
+func (t *HomeTemplate) Provision(u *User, checksums map[string]string) ([]string, error) {
+	return t.apply(u, checksums, true)
+}
+
+// Apply renders the templates into an user home directory, returning the
+// written files. Files are only written if missing or unchanged since last
+// applied, according to checksums which map the files to the checksum of
+// their last applied content, so the files edited by the user are kept.
+func (t *HomeTemplate) Apply(u *User, checksums map[string]string) ([]string, error) {
+	return t.apply(u, checksums, false)
+}
+
+// apply renders the templates into an user home directory
+func (t *HomeTemplate) apply(u *User, checksums map[string]string, overwrite bool) ([]string, error) {
+	written := []string{}
+	account, err := System.LookupUser(u.Username)
+	if err != nil {
+		return written, fmt.Errorf("failed to retrieve user %q details: %s", u.Username, err)
+	}
+	if account.Home == "" {
+		account.Home = u.HomeDir()
+	}
+	data := &HomeData{
+		Groups:      []string{},
+		Home:        account.Home,
+		IAMUsername: u.IAMUsername,
+		Region:      t.Region,
+		Tags:        u.Tags,
+		UID:         account.UID,
+		Username:    u.Username,
+	}
+	dirs := []string{filepath.Join(t.Dir, "default")}
+	for _, g := range u.Groups {
+		data.Groups = append(data.Groups, g.Name)
+		dirs = append(dirs, filepath.Join(t.Dir, "groups", g.Name))
+	}
+	files, err := templateFiles(dirs...)
+	if err != nil {
+		return written, err
+	}
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	home := filepath.Join(t.Root, account.Home)
+	for _, name := range names {
+		content, mode, err := renderTemplateFile(files[name], data)
+		if err != nil {
+			return written, err
+		}
+		ok, err := applyHomeFile(home, name, content, mode, account, checksums, overwrite)
+		if err != nil {
+			return written, fmt.Errorf("failed to write %q: %s", filepath.Join(home, name), err)
+		}
+		if ok {
+			written = append(written, name)
+		}
+	}
+	return written, nil
+}
+
+// templateFiles maps the files relative paths of the template directories
+// to their source, later directories take precedence. Missing directories
+// are ignored.
+func templateFiles(dirs ...string) (map[string]string, error) {
+	files := map[string]string{}
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == dir {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files[strings.TrimSuffix(rel, ".tmpl")] = path
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// renderTemplateFile returns a template file content, rendering .tmpl files
+func renderTemplateFile(path string, data *HomeData) ([]byte, os.FileMode, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !strings.HasSuffix(path, ".tmpl") {
+		return content, info.Mode().Perm(), nil
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(homeTemplateFuncs).Option("missingkey=zero").Parse(string(content))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse template %q: %s", path, err)
+	}
+	buf := &bytes.Buffer{}
+	if err = tmpl.Execute(buf, data); err != nil {
+		return nil, 0, fmt.Errorf("failed to render template %q: %s", path, err)
+	}
+	return buf.Bytes(), info.Mode().Perm(), nil
+}
+
+// applyHomeFile writes a file into an user home directory, owned by the
+// user, unless it was changed since last applied and overwrite is false.
+// Symbolic links are never followed, since the user controls its home
+// directory: paths are resolved one component at a time, relative to the
+// parent directory file descriptor and with O_NOFOLLOW, so directories
+// swapped for links by the user in between are never traversed.
+func applyHomeFile(home, name string, content []byte, mode os.FileMode, account *Account, checksums map[string]string, overwrite bool) (bool, error) {
+	dirfd, err := openHomeDir(home, filepath.Dir(name), account)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(dirfd)
+	path := filepath.Join(home, name)
+	base := filepath.Base(name)
+	sum := checksum(content)
+	current, err := readHomeFile(dirfd, base)
+	switch {
+	case err == syscall.ENOENT:
+	case err == errNotRegular:
+		log.Printf("Skipping home file %q, not a regular file", path)
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		if checksum(current) == sum {
+			checksums[name] = sum
+			return false, nil
+		}
+		if previous, ok := checksums[name]; !overwrite && (!ok || previous != checksum(current)) {
+			log.Printf("Skipping home file %q, it was changed since last applied", path)
+			return false, nil
+		}
+	}
+	tmp, err := writeHomeFile(dirfd, base, content, mode, account)
+	if err != nil {
+		return false, err
+	}
+	if err = syscall.Renameat(dirfd, tmp, dirfd, base); err != nil {
+		syscall.Unlinkat(dirfd, tmp)
+		return false, err
+	}
+	checksums[name] = sum
+	return true, nil
+}
+
+// errNotRegular is returned by readHomeFile for links, directories and other special files
+var errNotRegular = fmt.Errorf("not a regular file")
+
+// readHomeFile reads a regular file from a directory file descriptor, without following links
+func readHomeFile(dirfd int, name string) ([]byte, error) {
+	fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err == syscall.ELOOP {
+		return nil, errNotRegular
+	}
+	if err != nil {
+		return nil, err
+	}
+	fp := os.NewFile(uintptr(fd), name)
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errNotRegular
+	}
+	return ioutil.ReadAll(fp)
+}
+
+// writeHomeFile writes content to a new temporary file, owned by the user,
+// on a directory file descriptor, returning its name
+func writeHomeFile(dirfd int, name string, content []byte, mode os.FileMode, account *Account) (string, error) {
+	var tmp string
+	var fd int
+	var err error
+	for i := 0; i < 10; i++ {
+		tmp = fmt.Sprintf(".%s.%d", name, rand.Uint32())
+		fd, err = syscall.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+		if err != syscall.EEXIST {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	fp := os.NewFile(uintptr(fd), tmp)
+	if _, err = fp.Write(content); err == nil {
+		if err = fp.Chmod(mode); err == nil {
+			err = fchownAccount(int(fp.Fd()), account)
+		}
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		syscall.Unlinkat(dirfd, tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// openHomeDir opens the directory of a path relative to an user home
+// directory, creating the missing ones owned by the user. Each directory
+// is opened relative to its parent without following links and must be
+// owned by the user.
+func openHomeDir(home, rel string, account *Account) (int, error) {
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Open(home, flags, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open %q: %s", home, err)
+	}
+	dir := home
+	parts := []string{}
+	if rel != "." {
+		parts = strings.Split(rel, string(filepath.Separator))
+	}
+	for i := -1; i < len(parts); i++ {
+		created := false
+		if i >= 0 {
+			dir = filepath.Join(dir, parts[i])
+			err = syscall.Mkdirat(fd, parts[i], 0700)
+			if err != nil && err != syscall.EEXIST {
+				syscall.Close(fd)
+				return -1, fmt.Errorf("failed to create %q: %s", dir, err)
+			}
+			created = err == nil
+			next, err := syscall.Openat(fd, parts[i], flags, 0)
+			syscall.Close(fd)
+			if err == syscall.ELOOP || err == syscall.ENOTDIR {
+				return -1, fmt.Errorf("%q is not a directory", dir)
+			}
+			if err != nil {
+				return -1, fmt.Errorf("failed to open %q: %s", dir, err)
+			}
+			fd = next
+		}
+		if created {
+			err = fchownAccount(fd, account)
+		} else {
+			err = checkHomeDirOwner(fd, dir, account)
+		}
+		if err != nil {
+			syscall.Close(fd)
+			return -1, err
+		}
+	}
+	return fd, nil
+}
+
+// checkHomeDirOwner refuses directories not owned by the user when running as root
+func checkHomeDirOwner(fd int, dir string, account *Account) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	stat := &syscall.Stat_t{}
+	if err := syscall.Fstat(fd, stat); err != nil {
+		return err
+	}
+	if stat.Uid != account.UID {
+		return fmt.Errorf("%q is not owned by the user", dir)
+	}
+	return nil
+}
+
+// fchownAccount sets an open file owner to an user account when running as root
+func fchownAccount(fd int, account *Account) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return syscall.Fchown(fd, int(account.UID), int(account.GID))
+}
+
+// checksum returns the hex encoded SHA-256 of content
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
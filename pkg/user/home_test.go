@@ -0,0 +1,120 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHomeTemplateApply(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	err := f.AddUser(&Account{Home: "/home/rochacon", Name: "rochacon", UID: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmplDir := filepath.Join(f.Root, "templates")
+	writeTemplates(t, tmplDir, map[string]string{
+		"default/.bashrc.tmpl":               "# {{.Username}} {{.UID}}\n",
+		"default/data/README":                "readme\n",
+		"groups/admins/.aws/config.tmpl":     "region = {{.Region}}\n{{range split (index .Tags \"roles\")}}[profile {{.}}]\n{{end}}",
+		"groups/admins/data/README":          "admins readme\n",
+		"groups/developers/data/README.tmpl": "developers readme\n",
+	})
+	tmpl := &HomeTemplate{Dir: tmplDir, Region: "us-east-1", Root: f.Root}
+	u := &User{
+		Groups:   []*Group{&Group{Name: "admins"}},
+		Tags:     map[string]string{"roles": "dev prod"},
+		Username: "rochacon",
+	}
+	checksums := map[string]string{}
+	written, err := tmpl.Provision(u, checksums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 3 || len(checksums) != 3 {
+		t.Errorf("unexpected written files %#v, checksums %#v", written, checksums)
+	}
+	expected := map[string]string{
+		"home/rochacon/.bashrc":     "# rochacon 2000\n",
+		"home/rochacon/.aws/config": "region = us-east-1\n[profile dev]\n[profile prod]\n",
+		"home/rochacon/data/README": "admins readme\n",
+	}
+	for name, content := range expected {
+		if got := readRootFile(t, f, name); got != content {
+			t.Errorf("unexpected %s content %q, expected %q", name, got, content)
+		}
+	}
+
+	// files edited by the user are kept, unchanged ones are updated
+	bashrc := filepath.Join(f.Root, "home/rochacon/.bashrc")
+	if err = ioutil.WriteFile(bashrc, []byte("# mine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u.Tags["roles"] = "prod"
+	written, err = tmpl.Apply(u, checksums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || written[0] != ".aws/config" {
+		t.Errorf("expected only .aws/config to be written, got %#v", written)
+	}
+	if got := readRootFile(t, f, "home/rochacon/.bashrc"); got != "# mine\n" {
+		t.Errorf("user edited .bashrc was overwritten: %q", got)
+	}
+	if got := readRootFile(t, f, "home/rochacon/.aws/config"); got != "region = us-east-1\n[profile prod]\n" {
+		t.Errorf("unexpected .aws/config %q", got)
+	}
+}
+
+func TestHomeTemplateApplySymlink(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	err := f.AddUser(&Account{Home: "/home/rochacon", Name: "rochacon", UID: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmplDir := filepath.Join(f.Root, "templates")
+	writeTemplates(t, tmplDir, map[string]string{
+		"default/.aws/config": "[default]\n",
+		"default/.profile":    "# profile\n",
+	})
+	target := filepath.Join(f.Root, "etc/target")
+	if err = os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(f.Root, "home/rochacon")
+	if err = os.Symlink(target, filepath.Join(home, ".aws")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(filepath.Join(f.Root, "etc/passwd"), filepath.Join(home, ".profile")); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &HomeTemplate{Dir: tmplDir, Root: f.Root}
+	if _, err = tmpl.Provision(&User{Username: "rochacon"}, map[string]string{}); err == nil {
+		t.Errorf("expected symlinked directory to be refused")
+	}
+	if _, err = os.Stat(filepath.Join(target, "config")); !os.IsNotExist(err) {
+		t.Errorf("template was written through a symlink: %v", err)
+	}
+	if readRootFile(t, f, "etc/passwd") == "# profile\n" {
+		t.Errorf("template was written through a symlink")
+	}
+}
@@ -1 +1,230 @@
 package user
+
+import (
+	"fmt"
+	osuser "os/user"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// IAMDirectory is a Directory backed by AWS IAM
+type IAMDirectory struct {
+	IAM IAM
+	// Workers is the number of concurrent calls when fetching users
+	Workers int
+}
+
+// NewIAMDirectory instantiates a Directory for the given AWS IAM service
+func NewIAMDirectory(svc IAM) *IAMDirectory {
+	return &IAMDirectory{IAM: svc, Workers: DefaultWorkers}
+}
+
+// ConcurrentCalls returns the number of concurrent calls when fetching users
+func (d *IAMDirectory) ConcurrentCalls() int {
+	return d.Workers
+}
+
+// GroupMembers lists the users belonging to an AWS IAM group
+func (d *IAMDirectory) GroupMembers(group string) ([]*Identity, error) {
+	identities := []*Identity{}
+	input := &iam.GetGroupInput{
+		GroupName: aws.String(group),
+	}
+	for {
+		iamGroup, err := d.IAM.GetGroup(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+				return identities, osuser.UnknownGroupError(group)
+			}
+			return identities, fmt.Errorf("Error retrieving group %q info: %s", group, err)
+		}
+		for _, iamUser := range iamGroup.Users {
+			identities = append(identities, iamIdentity(iamUser))
+		}
+		if !aws.BoolValue(iamGroup.IsTruncated) {
+			return identities, nil
+		}
+		input.Marker = iamGroup.Marker
+	}
+}
+
+// SSHPublicKeys lists an AWS IAM user SSH public keys, retrieving the body of active keys only
+func (d *IAMDirectory) SSHPublicKeys(username string) ([]*SSHPublicKey, error) {
+	keys := []*SSHPublicKey{}
+	metadata := []*iam.SSHPublicKeyMetadata{}
+	input := &iam.ListSSHPublicKeysInput{
+		UserName: aws.String(username),
+	}
+	for {
+		sshKeys, err := d.IAM.ListSSHPublicKeys(input)
+		if err != nil {
+			return keys, err
+		}
+		metadata = append(metadata, sshKeys.SSHPublicKeys...)
+		if !aws.BoolValue(sshKeys.IsTruncated) {
+			break
+		}
+		input.Marker = sshKeys.Marker
+	}
+	for _, key := range metadata {
+		keys = append(keys, &SSHPublicKey{
+			ID:         aws.StringValue(key.SSHPublicKeyId),
+			Status:     aws.StringValue(key.Status),
+			UploadDate: aws.TimeValue(key.UploadDate),
+		})
+	}
+	// AWS IAM only returns keys bodies one at a time, fetch them concurrently
+	err := parallel(d.Workers, len(keys), func(i int) error {
+		if !keys[i].Active() {
+			return nil
+		}
+		out, err := d.IAM.GetSSHPublicKey(&iam.GetSSHPublicKeyInput{
+			Encoding:       aws.String(iam.EncodingTypeSsh),
+			SSHPublicKeyId: aws.String(keys[i].ID),
+			UserName:       aws.String(username),
+		})
+		if err != nil {
+			return err
+		}
+		keys[i].Body = aws.StringValue(out.SSHPublicKey.SSHPublicKeyBody)
+		return nil
+	})
+	if err != nil {
+		return []*SSHPublicKey{}, err
+	}
+	return keys, nil
+}
+
+// User retrieves an AWS IAM user, or nil if it doesn't exist
+func (d *IAMDirectory) User(username string) (*Identity, error) {
+	out, err := d.IAM.GetUser(&iam.GetUserInput{UserName: aws.String(username)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return iamIdentity(out.User), nil
+}
+
+// UserActivity retrieves an AWS IAM user access keys state and the latest
+// usage of its password or access keys
+func (d *IAMDirectory) UserActivity(username string, lastUsed bool) (*Activity, error) {
+	out, err := d.IAM.GetUser(&iam.GetUserInput{UserName: aws.String(username)})
+	if err != nil {
+		return nil, err
+	}
+	activity := &Activity{
+		Created:  aws.TimeValue(out.User.CreateDate),
+		LastUsed: aws.TimeValue(out.User.PasswordLastUsed),
+	}
+	input := &iam.ListAccessKeysInput{
+		UserName: aws.String(username),
+	}
+	for {
+		accessKeys, err := d.IAM.ListAccessKeys(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range accessKeys.AccessKeyMetadata {
+			activity.AccessKeys++
+			if aws.StringValue(key.Status) == iam.StatusTypeActive {
+				activity.ActiveAccessKeys++
+			}
+			if !lastUsed {
+				continue
+			}
+			keyLastUsed, err := d.IAM.GetAccessKeyLastUsed(&iam.GetAccessKeyLastUsedInput{AccessKeyId: key.AccessKeyId})
+			if err != nil {
+				return nil, err
+			}
+			if keyLastUsed.AccessKeyLastUsed != nil {
+				if used := aws.TimeValue(keyLastUsed.AccessKeyLastUsed.LastUsedDate); used.After(activity.LastUsed) {
+					activity.LastUsed = used
+				}
+			}
+		}
+		if !aws.BoolValue(accessKeys.IsTruncated) {
+			return activity, nil
+		}
+		input.Marker = accessKeys.Marker
+	}
+}
+
+// UserGroups lists the names of the AWS IAM groups an user belongs to
+func (d *IAMDirectory) UserGroups(username string) ([]string, error) {
+	groups := []string{}
+	input := &iam.ListGroupsForUserInput{
+		UserName: aws.String(username),
+	}
+	for {
+		userGroups, err := d.IAM.ListGroupsForUser(input)
+		if err != nil {
+			// deleted users belong to no groups
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+				return groups, nil
+			}
+			return groups, err
+		}
+		for _, group := range userGroups.Groups {
+			groups = append(groups, aws.StringValue(group.GroupName))
+		}
+		if !aws.BoolValue(userGroups.IsTruncated) {
+			return groups, nil
+		}
+		input.Marker = userGroups.Marker
+	}
+}
+
+// UserTags retrieves an AWS IAM user tags
+func (d *IAMDirectory) UserTags(username string) (map[string]string, error) {
+	tags := map[string]string{}
+	input := &iam.ListUserTagsInput{
+		UserName: aws.String(username),
+	}
+	for {
+		userTags, err := d.IAM.ListUserTags(input)
+		if err != nil {
+			return tags, err
+		}
+		for _, tag := range userTags.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		if !aws.BoolValue(userTags.IsTruncated) {
+			return tags, nil
+		}
+		input.Marker = userTags.Marker
+	}
+}
+
+// ListUsers lists the AWS IAM users under a path prefix
+func (d *IAMDirectory) ListUsers(pathPrefix string) ([]*Identity, error) {
+	identities := []*Identity{}
+	input := &iam.ListUsersInput{
+		PathPrefix: aws.String(pathPrefix),
+	}
+	for {
+		out, err := d.IAM.ListUsers(input)
+		if err != nil {
+			return identities, err
+		}
+		for _, iamUser := range out.Users {
+			identities = append(identities, iamIdentity(iamUser))
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			return identities, nil
+		}
+		input.Marker = out.Marker
+	}
+}
+
+// iamIdentity converts an AWS IAM user into an Identity
+func iamIdentity(iamUser *iam.User) *Identity {
+	return &Identity{
+		ID:       aws.StringValue(iamUser.UserId),
+		Path:     aws.StringValue(iamUser.Path),
+		Username: aws.StringValue(iamUser.UserName),
+	}
+}
@@ -0,0 +1,329 @@
+package user
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// fakeIAM is an in memory IAM returning paginated results
+type fakeIAM struct {
+	// accessKeys maps user names to access keys statuses, keys are named <username>-<index>
+	accessKeys map[string][]string
+	// groups maps group names to user names
+	groups map[string][]string
+	// keys maps user names to SSH public key bodies
+	keys map[string][]string
+	// lastUsed maps access keys to their last usage
+	lastUsed map[string]time.Time
+	// paths maps user names to paths, defaults to "/"
+	paths map[string]string
+	// tags maps user names to tags
+	tags map[string]map[string]string
+	// pageSize is the maximum number of items per page
+	pageSize int
+	// calls counts the calls per operation
+	calls map[string]int
+	mutex sync.Mutex
+}
+
+func newFakeIAM(pageSize int) *fakeIAM {
+	return &fakeIAM{
+		accessKeys: map[string][]string{},
+		groups:     map[string][]string{},
+		keys:       map[string][]string{},
+		lastUsed:   map[string]time.Time{},
+		paths:      map[string]string{},
+		tags:       map[string]map[string]string{},
+		pageSize:   pageSize,
+		calls:      map[string]int{},
+	}
+}
+
+// count records a call to an operation
+func (f *fakeIAM) count(operation string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls[operation]++
+}
+
+// page returns the start and end indexes of a page and the next marker
+func (f *fakeIAM) page(marker *string, total int) (int, int, *string) {
+	start := 0
+	if marker != nil {
+		start, _ = strconv.Atoi(*marker)
+	}
+	end := start + f.pageSize
+	if end >= total {
+		return start, total, nil
+	}
+	return start, end, aws.String(strconv.Itoa(end))
+}
+
+// user returns an user, if known
+func (f *fakeIAM) user(username string) *iam.User {
+	for _, name := range f.usernames() {
+		if name == username {
+			path, ok := f.paths[name]
+			if !ok {
+				path = "/"
+			}
+			return &iam.User{Path: aws.String(path), UserId: aws.String("ID" + name), UserName: aws.String(name)}
+		}
+	}
+	return nil
+}
+
+// usernames returns the sorted names of all known users
+func (f *fakeIAM) usernames() []string {
+	names := []string{}
+	add := func(name string) {
+		if !stringIn(name, names) {
+			names = append(names, name)
+		}
+	}
+	for _, members := range f.groups {
+		for _, name := range members {
+			add(name)
+		}
+	}
+	for name := range f.accessKeys {
+		add(name)
+	}
+	for name := range f.keys {
+		add(name)
+	}
+	for name := range f.paths {
+		add(name)
+	}
+	for name := range f.tags {
+		add(name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeIAM) GetAccessKeyLastUsed(input *iam.GetAccessKeyLastUsedInput) (*iam.GetAccessKeyLastUsedOutput, error) {
+	f.count("GetAccessKeyLastUsed")
+	out := &iam.GetAccessKeyLastUsedOutput{AccessKeyLastUsed: &iam.AccessKeyLastUsed{}}
+	if used, ok := f.lastUsed[*input.AccessKeyId]; ok {
+		out.AccessKeyLastUsed.LastUsedDate = aws.Time(used)
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) GetGroup(input *iam.GetGroupInput) (*iam.GetGroupOutput, error) {
+	f.count("GetGroup")
+	members, ok := f.groups[*input.GroupName]
+	if !ok {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, fmt.Sprintf("group %q not found", *input.GroupName), nil)
+	}
+	start, end, marker := f.page(input.Marker, len(members))
+	out := &iam.GetGroupOutput{
+		Group:       &iam.Group{GroupName: input.GroupName},
+		IsTruncated: aws.Bool(marker != nil),
+		Marker:      marker,
+	}
+	for _, name := range members[start:end] {
+		out.Users = append(out.Users, &iam.User{UserId: aws.String("ID" + name), UserName: aws.String(name)})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) GetSSHPublicKey(input *iam.GetSSHPublicKeyInput) (*iam.GetSSHPublicKeyOutput, error) {
+	f.count("GetSSHPublicKey")
+	i, _ := strconv.Atoi(*input.SSHPublicKeyId)
+	return &iam.GetSSHPublicKeyOutput{
+		SSHPublicKey: &iam.SSHPublicKey{
+			SSHPublicKeyBody: aws.String(f.keys[*input.UserName][i]),
+			SSHPublicKeyId:   input.SSHPublicKeyId,
+			Status:           aws.String(iam.StatusTypeActive),
+			UserName:         input.UserName,
+		},
+	}, nil
+}
+
+func (f *fakeIAM) GetUser(input *iam.GetUserInput) (*iam.GetUserOutput, error) {
+	f.count("GetUser")
+	u := f.user(*input.UserName)
+	if u == nil {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "user not found", nil)
+	}
+	return &iam.GetUserOutput{User: u}, nil
+}
+
+func (f *fakeIAM) ListAccessKeys(input *iam.ListAccessKeysInput) (*iam.ListAccessKeysOutput, error) {
+	f.count("ListAccessKeys")
+	statuses := f.accessKeys[*input.UserName]
+	start, end, marker := f.page(input.Marker, len(statuses))
+	out := &iam.ListAccessKeysOutput{
+		IsTruncated: aws.Bool(marker != nil),
+		Marker:      marker,
+	}
+	for i := start; i < end; i++ {
+		out.AccessKeyMetadata = append(out.AccessKeyMetadata, &iam.AccessKeyMetadata{
+			AccessKeyId: aws.String(fmt.Sprintf("%s-%d", *input.UserName, i)),
+			Status:      aws.String(statuses[i]),
+			UserName:    input.UserName,
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) ListGroupsForUser(input *iam.ListGroupsForUserInput) (*iam.ListGroupsForUserOutput, error) {
+	f.count("ListGroupsForUser")
+	groups := []string{}
+	for group, members := range f.groups {
+		if stringIn(*input.UserName, members) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	start, end, marker := f.page(input.Marker, len(groups))
+	out := &iam.ListGroupsForUserOutput{
+		IsTruncated: aws.Bool(marker != nil),
+		Marker:      marker,
+	}
+	for _, name := range groups[start:end] {
+		out.Groups = append(out.Groups, &iam.Group{GroupName: aws.String(name)})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) ListSSHPublicKeys(input *iam.ListSSHPublicKeysInput) (*iam.ListSSHPublicKeysOutput, error) {
+	f.count("ListSSHPublicKeys")
+	keys := f.keys[*input.UserName]
+	start, end, marker := f.page(input.Marker, len(keys))
+	out := &iam.ListSSHPublicKeysOutput{
+		IsTruncated: aws.Bool(marker != nil),
+		Marker:      marker,
+	}
+	for i := start; i < end; i++ {
+		out.SSHPublicKeys = append(out.SSHPublicKeys, &iam.SSHPublicKeyMetadata{
+			SSHPublicKeyId: aws.String(strconv.Itoa(i)),
+			Status:         aws.String(iam.StatusTypeActive),
+			UserName:       input.UserName,
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) ListUserTags(input *iam.ListUserTagsInput) (*iam.ListUserTagsOutput, error) {
+	f.count("ListUserTags")
+	keys := []string{}
+	for k := range f.tags[*input.UserName] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	start, end, marker := f.page(input.Marker, len(keys))
+	out := &iam.ListUserTagsOutput{
+		IsTruncated: aws.Bool(marker != nil),
+		Marker:      marker,
+		Tags:        []*iam.Tag{},
+	}
+	for _, k := range keys[start:end] {
+		out.Tags = append(out.Tags, &iam.Tag{Key: aws.String(k), Value: aws.String(f.tags[*input.UserName][k])})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) ListUsers(input *iam.ListUsersInput) (*iam.ListUsersOutput, error) {
+	f.count("ListUsers")
+	users := []*iam.User{}
+	for _, name := range f.usernames() {
+		u := f.user(name)
+		if strings.HasPrefix(*u.Path, aws.StringValue(input.PathPrefix)) {
+			users = append(users, u)
+		}
+	}
+	start, end, marker := f.page(input.Marker, len(users))
+	return &iam.ListUsersOutput{
+		IsTruncated: aws.Bool(marker != nil),
+		Marker:      marker,
+		Users:       users[start:end],
+	}, nil
+}
+
+func TestFromIAMGroupsPagination(t *testing.T) {
+	svc := newFakeIAM(100)
+	for i := 0; i < 250; i++ {
+		svc.groups["bastrd"] = append(svc.groups["bastrd"], fmt.Sprintf("user%03d", i))
+	}
+	users, err := FromIAMGroups(svc, &Group{Name: "bastrd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 250 {
+		t.Errorf("expected 250 users across all pages, got %d", len(users))
+	}
+	if svc.calls["GetGroup"] != 3 {
+		t.Errorf("expected 3 GetGroup calls, got %d", svc.calls["GetGroup"])
+	}
+}
+
+func TestIAMDirectorySSHPublicKeysPagination(t *testing.T) {
+	svc := newFakeIAM(2)
+	svc.keys["rochacon"] = []string{"ssh-rsa A", "ssh-rsa B", "ssh-rsa C", "ssh-rsa D", "ssh-rsa E"}
+	keys, err := NewIAMDirectory(svc).SSHPublicKeys("rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 5 || keys[4].Body != "ssh-rsa E" {
+		t.Errorf("expected 5 keys across all pages, got %#v", keys)
+	}
+	if svc.calls["ListSSHPublicKeys"] != 3 {
+		t.Errorf("expected 3 ListSSHPublicKeys calls, got %d", svc.calls["ListSSHPublicKeys"])
+	}
+}
+
+func TestIAMDirectoryUserGroupsPagination(t *testing.T) {
+	svc := newFakeIAM(1)
+	svc.groups["bastrd"] = []string{"rochacon"}
+	svc.groups["admins"] = []string{"rochacon"}
+	svc.groups["developers"] = []string{"someone"}
+	groups, err := NewIAMDirectory(svc).UserGroups("rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Errorf("expected 2 groups across all pages, got %#v", groups)
+	}
+}
+
+func TestIAMDirectoryUserActivity(t *testing.T) {
+	svc := newFakeIAM(1)
+	svc.accessKeys["rochacon"] = []string{iam.StatusTypeInactive, iam.StatusTypeActive, iam.StatusTypeInactive}
+	lastUsed := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	svc.lastUsed["rochacon-0"] = lastUsed
+	svc.lastUsed["rochacon-1"] = lastUsed.Add(-time.Hour)
+	activity, err := NewIAMDirectory(svc).UserActivity("rochacon", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activity.AccessKeys != 3 || activity.ActiveAccessKeys != 1 || !activity.LastUsed.Equal(lastUsed) {
+		t.Errorf("unexpected activity %#v", activity)
+	}
+	if svc.calls["ListAccessKeys"] != 3 || svc.calls["GetAccessKeyLastUsed"] != 3 {
+		t.Errorf("expected 3 ListAccessKeys and GetAccessKeyLastUsed calls, got %v", svc.calls)
+	}
+
+	// without last usage access keys are only counted
+	activity, err = NewIAMDirectory(svc).UserActivity("rochacon", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activity.AccessKeys != 3 || activity.ActiveAccessKeys != 1 || !activity.LastUsed.IsZero() {
+		t.Errorf("unexpected activity %#v", activity)
+	}
+	if svc.calls["GetAccessKeyLastUsed"] != 3 {
+		t.Errorf("expected no GetAccessKeyLastUsed calls, got %v", svc.calls)
+	}
+}
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultJournalPath is the default location of the sync change journal
+const DefaultJournalPath = "/var/lib/bastrd/journal.jsonl"
+
+// Journal actions
+const (
+	JournalCreate = "create"
+	JournalModify = "modify"
+	JournalRemove = "remove"
+)
+
+// JournalEntry records a change applied by sync to a system user
+type JournalEntry struct {
+	// Action is either JournalCreate, JournalModify or JournalRemove
+	Action string `json:"action"`
+	// Change describes the change, e.g. "add to group \"docker\""
+	Change string `json:"change"`
+	// Error is set if the change failed
+	Error       string    `json:"error,omitempty"`
+	IAMUserID   string    `json:"iam_user_id,omitempty"`
+	IAMUsername string    `json:"iam_username,omitempty"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+	Username    string    `json:"username"`
+}
+
+// Journal is an append-only JSON lines file of JournalEntry
+type Journal struct {
+	Path string
+}
+
+// Append writes entries to the end of the journal
+func (j *Journal) Append(entries ...*JournalEntry) error {
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0700); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(j.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fp)
+	for _, entry := range entries {
+		if err = enc.Encode(entry); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// Read returns the journal entries accepted by filter, in order. An
+// unexistent journal has no entries.
+func (j *Journal) Read(filter func(*JournalEntry) bool) ([]*JournalEntry, error) {
+	entries := []*JournalEntry{}
+	fp, err := os.Open(j.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := &JournalEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return entries, fmt.Errorf("invalid journal %q entry on line %d: %s", j.Path, line, err)
+		}
+		if filter == nil || filter(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// String renders a human readable journal entry
+func (e *JournalEntry) String() string {
+	s := fmt.Sprintf("%s %-6s %s: %s (%s)", e.Time.Format(time.RFC3339), e.Action, e.Username, e.Change, e.Reason)
+	if e.Error != "" {
+		s += fmt.Sprintf(" failed: %s", e.Error)
+	}
+	return s
+}
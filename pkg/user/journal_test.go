@@ -0,0 +1,49 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := &Journal{Path: filepath.Join(dir, "journal.jsonl")}
+	entries, err := journal.Read(nil)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected an unexistent journal to be empty, got %#v: %v", entries, err)
+	}
+	now := time.Now().UTC()
+	err = journal.Append(
+		&JournalEntry{Action: JournalCreate, Change: "create user", Reason: "selected on AWS IAM", Time: now, Username: "rochacon"},
+		&JournalEntry{Action: JournalModify, Change: "add to group \"docker\"", Reason: "granted by AWS IAM", Time: now, Username: "rochacon"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Append(&JournalEntry{Action: JournalRemove, Change: "delete user", Error: "boom", Time: now, Username: "leaver"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = journal.Read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Action != JournalCreate || entries[2].Username != "leaver" {
+		t.Errorf("unexpected entries %#v", entries)
+	}
+	entries, err = journal.Read(func(e *JournalEntry) bool { return e.Username == "leaver" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].String(), "failed: boom") {
+		t.Errorf("unexpected filtered entries %#v", entries)
+	}
+}
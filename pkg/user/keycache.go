@@ -0,0 +1,238 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultKeyCacheDir is where users SSH public keys are cached for authorized-keys
+const DefaultKeyCacheDir = "/var/cache/bastrd/keys"
+
+// keyCacheOwner is the uid owning trusted key cache paths, root unless testing
+var keyCacheOwner uint32 = 0
+
+// KeyCacheEntry is an user groups, selection attributes and active SSH
+// public keys, as needed to authorize its SSH logins
+type KeyCacheEntry struct {
+	Groups      []string          `json:"groups"`
+	IAMUsername string            `json:"iam_username"`
+	Keys        []*SSHPublicKey   `json:"keys"`
+	Path        string            `json:"path"`
+	Tags        map[string]string `json:"tags"`
+	Updated     time.Time         `json:"updated"`
+}
+
+// Allowed checks wether the user belongs to any of the groups or is chosen by the selector
+func (e *KeyCacheEntry) Allowed(groups []string, selector *Selector) bool {
+	for _, group := range e.Groups {
+		if stringIn(group, groups) {
+			return true
+		}
+	}
+	return !selector.Empty() && selector.Matches(e.Path, e.Tags)
+}
+
+// MatchKeys returns the keys with the fingerprint and type, see SSHPublicKey.Matches
+func (e *KeyCacheEntry) MatchKeys(fingerprint, keyType string) []*SSHPublicKey {
+	keys := []*SSHPublicKey{}
+	for _, key := range e.Keys {
+		if key.Matches(fingerprint, keyType) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// LookupKeys retrieves an user groups, selection attributes and active SSH
+// public keys from a directory, nil if the user doesn't exist
+func LookupKeys(dir Directory, iamUsername string) (*KeyCacheEntry, error) {
+	identity, err := dir.User(iamUsername)
+	if err != nil || identity == nil {
+		return nil, err
+	}
+	entry := &KeyCacheEntry{IAMUsername: iamUsername, Keys: []*SSHPublicKey{}, Path: identity.Path, Updated: time.Now().UTC()}
+	if entry.Groups, err = dir.UserGroups(iamUsername); err != nil {
+		return nil, fmt.Errorf("failed to list user %q groups: %s", iamUsername, err)
+	}
+	if entry.Tags, err = dir.UserTags(iamUsername); err != nil {
+		return nil, fmt.Errorf("failed to list user %q tags: %s", iamUsername, err)
+	}
+	keys, err := dir.SSHPublicKeys(iamUsername)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user %q SSH public keys: %s", iamUsername, err)
+	}
+	for _, key := range keys {
+		if !key.Active() {
+			log.Printf("Skipping user %q SSH public key %q, status %q", iamUsername, key.ID, key.Status)
+			continue
+		}
+		entry.Keys = append(entry.Keys, key)
+	}
+	return entry, nil
+}
+
+// LookupAllKeys looks the users up concurrently, entries of users that
+// don't exist are nil
+func LookupAllKeys(dir Directory, iamUsernames []string) ([]*KeyCacheEntry, error) {
+	entries := make([]*KeyCacheEntry, len(iamUsernames))
+	err := parallel(directoryWorkers(dir), len(iamUsernames), func(i int) (err error) {
+		entries[i], err = LookupKeys(dir, iamUsernames[i])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// KeyCache stores KeyCacheEntry files readable by the unprivileged
+// AuthorizedKeysCommandUser. Entries are only trusted if the cache directory
+// and files are owned by root and not writable by others.
+type KeyCache struct {
+	Dir string
+	// TTL is how long entries are used instead of looking users up
+	TTL time.Duration
+	// StaleIfError is how long after the TTL entries are still used when looking users up fails
+	StaleIfError time.Duration
+}
+
+// Get reads an user entry, nil if there is none
+func (c *KeyCache) Get(iamUsername string) (*KeyCacheEntry, error) {
+	if err := trustedPath(c.Dir, true); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	path := c.path(iamUsername)
+	if err := trustedPath(path, false); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &KeyCacheEntry{}
+	if err = json.Unmarshal(content, entry); err != nil {
+		return nil, fmt.Errorf("failed to parse key cache %q: %s", path, err)
+	}
+	return entry, nil
+}
+
+// Fresh checks wether an entry can be used without looking the user up
+func (c *KeyCache) Fresh(entry *KeyCacheEntry, now time.Time) bool {
+	return entry != nil && now.Sub(entry.Updated) < c.TTL
+}
+
+// Usable checks wether an entry can be used when looking the user up failed
+func (c *KeyCache) Usable(entry *KeyCacheEntry, now time.Time) bool {
+	return entry != nil && now.Sub(entry.Updated) < c.TTL+c.StaleIfError
+}
+
+// Put writes an user entry
+func (c *KeyCache) Put(entry *KeyCacheEntry) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(entry.IAMUsername), content, 0644)
+}
+
+// Delete removes an user entry
+func (c *KeyCache) Delete(iamUsername string) error {
+	err := os.Remove(c.path(iamUsername))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Refresh looks the users up concurrently and writes their entries,
+// removing the ones of users that don't exist anymore. Users are refreshed
+// independently, the entries of users failing are left as they are, nil on
+// the returned entries, and the failures reported once the others are done.
+func (c *KeyCache) Refresh(dir Directory, iamUsernames []string) ([]*KeyCacheEntry, error) {
+	entries := make([]*KeyCacheEntry, len(iamUsernames))
+	errs := make([]error, len(iamUsernames))
+	parallel(directoryWorkers(dir), len(iamUsernames), func(i int) error {
+		entries[i], errs[i] = LookupKeys(dir, iamUsernames[i])
+		return nil
+	})
+	failed := []string{}
+	for i, entry := range entries {
+		err := errs[i]
+		switch {
+		case err != nil:
+		case entry == nil:
+			err = c.Delete(iamUsernames[i])
+		default:
+			err = c.Put(entry)
+		}
+		if err != nil {
+			log.Printf("Failed to refresh user %q key cache: %s", iamUsernames[i], err)
+			entries[i] = nil
+			failed = append(failed, iamUsernames[i])
+		}
+	}
+	if len(failed) > 0 {
+		return entries, fmt.Errorf("failed to refresh %d user(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return entries, nil
+}
+
+// Prune removes the entries of users not in keep
+func (c *KeyCache) Prune(keep []string) error {
+	files, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		iamUsername := strings.TrimSuffix(filepath.Base(file), ".json")
+		if stringIn(iamUsername, keep) {
+			continue
+		}
+		if err = c.Delete(iamUsername); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path returns the entry file of an user, AWS IAM usernames hold no slashes
+func (c *KeyCache) path(iamUsername string) string {
+	return filepath.Join(c.Dir, iamUsername+".json")
+}
+
+// trustedPath checks a path is owned by root and not writable by group or
+// others, authorized-keys runs unprivileged so its own files aren't trusted
+func trustedPath(path string, dir bool) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if dir != info.IsDir() || (!dir && !info.Mode().IsRegular()) {
+		return fmt.Errorf("untrusted key cache %q: unexpected file type", path)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("untrusted key cache %q: writable by group or others", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != keyCacheOwner {
+		return fmt.Errorf("untrusted key cache %q: owned by uid %d", path, stat.Uid)
+	}
+	return nil
+}
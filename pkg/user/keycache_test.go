@@ -0,0 +1,178 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyCache(t *testing.T) {
+	defer func(uid uint32) { keyCacheOwner = uid }(keyCacheOwner)
+	keyCacheOwner = uint32(os.Geteuid())
+	path, cleanup := writeTempFile(t, "directory.yml", `
+groups:
+  bastrd: [rochacon, alice]
+users:
+  rochacon:
+    path: /engineering/
+    tags: {team: platform}
+    ssh_public_keys:
+      - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample rochacon
+  alice: {}
+`)
+	defer cleanup()
+	dir, err := LoadFileDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &KeyCache{Dir: filepath.Join(filepath.Dir(path), "keys"), TTL: time.Minute, StaleIfError: time.Hour}
+	if entry, err := cache.Get("rochacon"); err != nil || entry != nil {
+		t.Fatalf("expected no entry on a missing cache, got %#v, %v", entry, err)
+	}
+	entries, err := cache.Refresh(dir, []string{"rochacon", "alice", "deleted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].IAMUsername != "rochacon" || entries[2] != nil {
+		t.Fatalf("unexpected refreshed entries %#v", entries)
+	}
+	entry, err := cache.Get("rochacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || len(entry.Keys) != 1 || entry.Path != "/engineering/" || entry.Tags["team"] != "platform" {
+		t.Fatalf("unexpected entry %#v", entry)
+	}
+	if !entry.Allowed([]string{"bastrd"}, nil) || entry.Allowed([]string{"admins"}, nil) {
+		t.Errorf("expected entry to be allowed by group bastrd only")
+	}
+	if !entry.Allowed([]string{"admins"}, &Selector{Tags: map[string]string{"team": "platform"}}) {
+		t.Errorf("expected entry to be allowed by the selector")
+	}
+	if deleted, _ := cache.Get("deleted"); deleted != nil {
+		t.Errorf("unexpected entry of an unknown user %#v", deleted)
+	}
+
+	now := entry.Updated
+	if !cache.Fresh(entry, now.Add(30*time.Second)) || cache.Fresh(entry, now.Add(2*time.Minute)) {
+		t.Errorf("expected entry to be fresh for the TTL only")
+	}
+	if !cache.Usable(entry, now.Add(time.Hour)) || cache.Usable(entry, now.Add(2*time.Hour)) {
+		t.Errorf("expected entry to be usable for the TTL and stale if error window only")
+	}
+
+	if err = cache.Prune([]string{"rochacon"}); err != nil {
+		t.Fatal(err)
+	}
+	if alice, _ := cache.Get("alice"); alice != nil {
+		t.Errorf("expected pruned entry to be removed")
+	}
+
+	// entries writable by others can't be trusted
+	if err = os.Chmod(cache.path("rochacon"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Get("rochacon"); err == nil {
+		t.Errorf("expected untrusted entry to fail")
+	}
+}
+
+// failingKeysDirectory fails listing an user SSH public keys
+type failingKeysDirectory struct {
+	*FileDirectory
+	username string
+}
+
+func (d *failingKeysDirectory) SSHPublicKeys(username string) ([]*SSHPublicKey, error) {
+	if username == d.username {
+		return nil, errors.New("throttled")
+	}
+	return d.FileDirectory.SSHPublicKeys(username)
+}
+
+func TestKeyCacheRefreshUsersIndependently(t *testing.T) {
+	defer func(uid uint32) { keyCacheOwner = uid }(keyCacheOwner)
+	keyCacheOwner = uint32(os.Geteuid())
+	path, cleanup := writeTempFile(t, "directory.yml", `
+users:
+  rochacon: {}
+  alice: {}
+`)
+	defer cleanup()
+	files, err := LoadFileDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &KeyCache{Dir: filepath.Join(filepath.Dir(path), "keys"), TTL: time.Minute, StaleIfError: time.Hour}
+	if _, err = cache.Refresh(files, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	previous, _ := cache.Get("alice")
+	entries, err := cache.Refresh(&failingKeysDirectory{files, "alice"}, []string{"alice", "rochacon"})
+	if err == nil {
+		t.Fatal("expected the failing user to be reported")
+	}
+	if len(entries) != 2 || entries[0] != nil || entries[1] == nil {
+		t.Fatalf("unexpected refreshed entries %#v", entries)
+	}
+	if entry, _ := cache.Get("rochacon"); entry == nil {
+		t.Errorf("expected other users to be refreshed")
+	}
+	if entry, _ := cache.Get("alice"); entry == nil || !entry.Updated.Equal(previous.Updated) {
+		t.Errorf("expected the failing user entry to be kept, got %#v", entry)
+	}
+}
+
+func TestKeyCacheEntryMatchKeys(t *testing.T) {
+	keys := []*SSHPublicKey{}
+	fingerprints := []string{}
+	for _, id := range []string{"APKAONE", "APKATWO"} {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, &SSHPublicKey{Body: string(ssh.MarshalAuthorizedKey(key)), ID: id, Status: KeyStatusActive})
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+		if id == "APKATWO" {
+			fingerprints = append(fingerprints, "MD5:"+ssh.FingerprintLegacyMD5(key))
+		}
+	}
+	keys = append(keys, &SSHPublicKey{Body: "invalid", ID: "APKAINVALID", Status: KeyStatusActive})
+	entry := &KeyCacheEntry{Keys: keys}
+
+	tests := []struct {
+		fingerprint string
+		keyType     string
+		expected    []string
+	}{
+		{fingerprints[0], "", []string{"APKAONE"}},
+		{fingerprints[0], "ssh-ed25519", []string{"APKAONE"}},
+		{fingerprints[0], "ssh-rsa", []string{}},
+		{fingerprints[1], "ssh-ed25519", []string{"APKATWO"}},
+		{fingerprints[2], "", []string{"APKATWO"}},
+		{"SHA256:unknown", "", []string{}},
+	}
+	for _, test := range tests {
+		ids := []string{}
+		for _, key := range entry.MatchKeys(test.fingerprint, test.keyType) {
+			ids = append(ids, key.ID)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("expected fingerprint %q type %q to match %v, got %v", test.fingerprint, test.keyType, test.expected, ids)
+		}
+	}
+	if fingerprint, err := keys[0].Fingerprint(); err != nil || fingerprint != fingerprints[0] {
+		t.Errorf("unexpected fingerprint %q, %v", fingerprint, err)
+	}
+}
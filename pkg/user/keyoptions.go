@@ -0,0 +1,127 @@
+package user
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyOptionsRule attaches OpenSSH authorized_keys options, e.g. restrict,pty
+// or from="10.0.0.0/8", to the SSH public keys of a group members or of the
+// users with a tag
+type KeyOptionsRule struct {
+	Group    string
+	Options  []string
+	TagKey   string
+	TagValue string
+}
+
+// ParseKeyOptionsRule parses a group:options or tag:key=value:options rule
+func ParseKeyOptionsRule(s string) (*KeyOptionsRule, error) {
+	rule := &KeyOptionsRule{}
+	rest := s
+	if strings.HasPrefix(s, "tag:") {
+		parts := strings.SplitN(strings.TrimPrefix(s, "tag:"), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key options rule %q, expected tag:key=value:options", s)
+		}
+		rule.TagKey, rest = parts[0], parts[1]
+	}
+	parts := strings.SplitN(rest, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return nil, fmt.Errorf("invalid key options rule %q, expected group:options or tag:key=value:options", s)
+	}
+	if rule.TagKey != "" {
+		rule.TagValue = parts[0]
+	} else if rule.Group = strings.TrimSpace(parts[0]); rule.Group == "" {
+		return nil, fmt.Errorf("invalid key options rule %q, missing group name", s)
+	}
+	options, err := splitKeyOptions(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key options rule %q: %s", s, err)
+	}
+	rule.Options = options
+	return rule, nil
+}
+
+// Matches checks wether the rule applies to a cached user
+func (r *KeyOptionsRule) Matches(entry *KeyCacheEntry) bool {
+	if r.TagKey != "" {
+		value, ok := entry.Tags[r.TagKey]
+		return ok && value == r.TagValue
+	}
+	return stringIn(r.Group, entry.Groups)
+}
+
+// AuthorizedKeys returns the entry keys as authorized_keys lines, prefixed
+// by the options of the matching rules, in order. The first rule setting an
+// option wins. With expiry, keys of users with the expires tag get an
+// expiry-time option, supported by OpenSSH 8.2 and later. sshd reads dates
+// without a timezone in its local time, so the tag date is rendered in UTC.
+func (e *KeyCacheEntry) AuthorizedKeys(rules []*KeyOptionsRule, expiry bool) []string {
+	options := []string{}
+	names := []string{}
+	add := func(option string) {
+		name := strings.ToLower(strings.SplitN(option, "=", 2)[0])
+		if stringIn(name, names) {
+			return
+		}
+		names = append(names, name)
+		options = append(options, option)
+	}
+	for _, rule := range rules {
+		if !rule.Matches(e) {
+			continue
+		}
+		for _, option := range rule.Options {
+			add(option)
+		}
+	}
+	if expiry {
+		u := &User{Username: e.IAMUsername, Tags: e.Tags}
+		if expires := u.TagExpiration(); !expires.IsZero() {
+			add(fmt.Sprintf("expiry-time=%q", expires.UTC().Format("20060102150405Z")))
+		}
+	}
+	lines := []string{}
+	for _, key := range e.Keys {
+		line := key.Body
+		if len(options) > 0 {
+			line = strings.Join(options, ",") + " " + line
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitKeyOptions splits comma separated authorized_keys options, commas and
+// spaces are allowed inside double quoted values only
+func splitKeyOptions(s string) ([]string, error) {
+	if strings.ContainsAny(s, "\n\r") {
+		return nil, fmt.Errorf("options must be a single line")
+	}
+	options := []string{}
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"' && (i == 0 || s[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == ' ' || c == '\t':
+			return nil, fmt.Errorf("unexpected space outside quotes")
+		case c == ',':
+			options = append(options, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	options = append(options, s[start:])
+	for _, option := range options {
+		if option == "" {
+			return nil, fmt.Errorf("empty option")
+		}
+	}
+	return options, nil
+}
@@ -0,0 +1,71 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeyOptionsRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected *KeyOptionsRule
+	}{
+		{"contractors:restrict,pty", &KeyOptionsRule{Group: "contractors", Options: []string{"restrict", "pty"}}},
+		{`vpn:from="10.0.0.0/8,192.168.0.0/16"`, &KeyOptionsRule{Group: "vpn", Options: []string{`from="10.0.0.0/8,192.168.0.0/16"`}}},
+		{`tag:bastrd:sandbox=true:command="/opt/bin/bastrd toolbox"`, &KeyOptionsRule{Options: []string{`command="/opt/bin/bastrd toolbox"`}, TagKey: "bastrd:sandbox", TagValue: "true"}},
+		{`tunnels:permitopen="db.internal:5432",permitopen="cache:6379"`, &KeyOptionsRule{Group: "tunnels", Options: []string{`permitopen="db.internal:5432"`, `permitopen="cache:6379"`}}},
+		{`tag:team=data:permitopen="db.internal:5432"`, &KeyOptionsRule{Options: []string{`permitopen="db.internal:5432"`}, TagKey: "team", TagValue: "data"}},
+		{"contractors", nil},
+		{"contractors:", nil},
+		{":restrict", nil},
+		{"tag:team:restrict", nil},
+		{"contractors:restrict, pty", nil},
+		{`contractors:command="/bin/sh`, nil},
+		{"contractors:restrict,,pty", nil},
+		{"contractors:restrict\nssh-rsa AAAA", nil},
+	}
+	for _, test := range tests {
+		rule, err := ParseKeyOptionsRule(test.rule)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("expected rule %q to fail, got %#v", test.rule, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected rule %q error: %s", test.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(rule, test.expected) {
+			t.Errorf("unexpected rule %q: %#v", test.rule, rule)
+		}
+	}
+}
+
+func TestKeyCacheEntryAuthorizedKeys(t *testing.T) {
+	rules := []*KeyOptionsRule{}
+	for _, r := range []string{"contractors:restrict,pty", `vpn:from="10.0.0.0/8"`, `admins:from="0.0.0.0/0",agent-forwarding`, "tag:team=platform:no-port-forwarding"} {
+		rule, err := ParseKeyOptionsRule(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	entry := &KeyCacheEntry{
+		Groups: []string{"vpn", "contractors", "admins"},
+		Keys:   []*SSHPublicKey{{Body: "ssh-ed25519 A one"}, {Body: "ssh-ed25519 B two"}},
+		Tags:   map[string]string{TagExpires: "2026-12-31", "team": "platform"},
+	}
+	expected := []string{
+		`restrict,pty,from="10.0.0.0/8",agent-forwarding,no-port-forwarding,expiry-time="20261231000000Z" ssh-ed25519 A one`,
+		`restrict,pty,from="10.0.0.0/8",agent-forwarding,no-port-forwarding,expiry-time="20261231000000Z" ssh-ed25519 B two`,
+	}
+	if lines := entry.AuthorizedKeys(rules, true); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("unexpected authorized keys %#v", lines)
+	}
+
+	entry = &KeyCacheEntry{Groups: []string{"bastrd"}, Keys: []*SSHPublicKey{{Body: "ssh-ed25519 A one"}}, Tags: map[string]string{TagExpires: "2026-12-31"}}
+	if lines := entry.AuthorizedKeys(rules, false); !reflect.DeepEqual(lines, []string{"ssh-ed25519 A one"}) {
+		t.Errorf("expected bare keys, got %#v", lines)
+	}
+}
@@ -0,0 +1,110 @@
+package user
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKeyAlgorithms are the SSH public key algorithms allowed by default, all but DSA
+var DefaultKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoRSA,
+}
+
+// KeyPolicy restricts the SSH public keys accepted for login. A nil KeyPolicy accepts any key.
+type KeyPolicy struct {
+	// Algorithms are the allowed key types, DefaultKeyAlgorithms if empty
+	Algorithms []string
+	// MaxAge is the maximum time since the key upload, unlimited if zero
+	MaxAge time.Duration
+	// MinRSABits is the minimum RSA key size
+	MinRSABits int
+}
+
+// Check validates a directory key against the policy
+func (p *KeyPolicy) Check(key *SSHPublicKey, now time.Time) error {
+	if p == nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Body))
+	if err != nil {
+		return fmt.Errorf("invalid key: %s", err)
+	}
+	return p.CheckKey(pub, key.UploadDate, now)
+}
+
+// CheckKey validates a public key uploaded at the given time against the
+// policy, the key age isn't checked if uploaded is zero
+func (p *KeyPolicy) CheckKey(pub ssh.PublicKey, uploaded, now time.Time) error {
+	if p == nil {
+		return nil
+	}
+	algorithms := p.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultKeyAlgorithms
+	}
+	if !stringIn(pub.Type(), algorithms) {
+		return fmt.Errorf("algorithm %s is not allowed", pub.Type())
+	}
+	if cryptoKey, ok := pub.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < p.MinRSABits {
+			return fmt.Errorf("RSA key of %d bits is shorter than %d bits", rsaKey.N.BitLen(), p.MinRSABits)
+		}
+	}
+	if p.MaxAge > 0 && !uploaded.IsZero() && now.Sub(uploaded) > p.MaxAge {
+		return fmt.Errorf("uploaded on %s, older than %s", uploaded.Format("2006-01-02"), p.MaxAge)
+	}
+	return nil
+}
+
+// KeyViolation is an SSH public key failing the KeyPolicy
+type KeyViolation struct {
+	Fingerprint string `json:"fingerprint"`
+	ID          string `json:"id"`
+	Reason      string `json:"reason"`
+}
+
+// KeyCompliance is an user SSH public keys compliance with the KeyPolicy
+type KeyCompliance struct {
+	IAMUsername string `json:"iam_username"`
+	// Keys is the number of active keys
+	Keys       int             `json:"keys"`
+	Violations []*KeyViolation `json:"violations"`
+}
+
+// Compliance checks the entry active keys against the policy
+func (p *KeyPolicy) Compliance(entry *KeyCacheEntry, now time.Time) *KeyCompliance {
+	c := &KeyCompliance{IAMUsername: entry.IAMUsername, Keys: len(entry.Keys), Violations: []*KeyViolation{}}
+	for _, key := range entry.Keys {
+		err := p.Check(key, now)
+		if err == nil {
+			continue
+		}
+		fingerprint, _ := key.Fingerprint()
+		c.Violations = append(c.Violations, &KeyViolation{Fingerprint: fingerprint, ID: key.ID, Reason: err.Error()})
+	}
+	return c
+}
+
+// String describes the user compliance, one line per violation
+func (c *KeyCompliance) String() string {
+	buf := &bytes.Buffer{}
+	if len(c.Violations) == 0 {
+		fmt.Fprintf(buf, "%s: %d key(s), compliant", c.IAMUsername, c.Keys)
+		return buf.String()
+	}
+	fmt.Fprintf(buf, "%s: %d of %d key(s) non-compliant", c.IAMUsername, len(c.Violations), c.Keys)
+	for _, v := range c.Violations {
+		fmt.Fprintf(buf, "\n  %s %s: %s", v.ID, v.Fingerprint, v.Reason)
+	}
+	return buf.String()
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"crypto/dsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestKey returns a directory key with the authorized_keys body of pub
+func newTestKey(t *testing.T, id string, pub interface{}, uploaded time.Time) *SSHPublicKey {
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SSHPublicKey{Body: string(ssh.MarshalAuthorizedKey(key)), ID: id, Status: KeyStatusActive, UploadDate: uploaded}
+}
+
+func TestKeyPolicyCheck(t *testing.T) {
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsaKey := &dsa.PrivateKey{}
+	if err = dsa.GenerateParameters(&dsaKey.Parameters, rand.Reader, dsa.L1024N160); err != nil {
+		t.Fatal(err)
+	}
+	if err = dsa.GenerateKey(dsaKey, rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &KeyPolicy{MaxAge: 365 * 24 * time.Hour, MinRSABits: 2048}
+	tests := []struct {
+		key    *SSHPublicKey
+		reason string
+	}{
+		{newTestKey(t, "ed25519", edPub, now.AddDate(0, -1, 0)), ""},
+		{newTestKey(t, "rsa2048", &rsa2048.PublicKey, now.AddDate(0, -1, 0)), ""},
+		{newTestKey(t, "unknown-age", edPub, time.Time{}), ""},
+		{newTestKey(t, "rsa1024", &rsa1024.PublicKey, now), "RSA key of 1024 bits is shorter than 2048 bits"},
+		{newTestKey(t, "dsa", &dsaKey.PublicKey, now), "algorithm ssh-dss is not allowed"},
+		{newTestKey(t, "old", edPub, now.AddDate(-2, 0, 0)), "uploaded on 2024-10-16, older than 8760h0m0s"},
+		{&SSHPublicKey{Body: "ssh-ed25519 invalid", ID: "invalid"}, "invalid key"},
+	}
+	for _, test := range tests {
+		err := policy.Check(test.key, now)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("expected key %q to pass, got %s", test.key.ID, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.reason) {
+			t.Errorf("expected key %q to fail with %q, got %v", test.key.ID, test.reason, err)
+		}
+	}
+
+	policy = &KeyPolicy{Algorithms: []string{ssh.KeyAlgoRSA}}
+	if err = policy.Check(tests[0].key, now); err == nil {
+		t.Errorf("expected ed25519 key to fail an RSA only policy")
+	}
+	if err = (*KeyPolicy)(nil).Check(tests[4].key, now); err != nil {
+		t.Errorf("expected nil policy to accept any key, got %s", err)
+	}
+}
+
+func TestKeyPolicyCompliance(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	entry := &KeyCacheEntry{IAMUsername: "rochacon", Keys: []*SSHPublicKey{
+		newTestKey(t, "APKANEW", edPub, now),
+		newTestKey(t, "APKAOLD", edPub, now.AddDate(-1, 0, -1)),
+	}}
+	policy := &KeyPolicy{MaxAge: 365 * 24 * time.Hour}
+	c := policy.Compliance(entry, now)
+	if c.Keys != 2 || len(c.Violations) != 1 || c.Violations[0].ID != "APKAOLD" || !strings.HasPrefix(c.Violations[0].Fingerprint, "SHA256:") {
+		t.Errorf("unexpected compliance %#v", c)
+	}
+	if lines := strings.Split(c.String(), "\n"); len(lines) != 2 || lines[0] != "rochacon: 1 of 2 key(s) non-compliant" {
+		t.Errorf("unexpected compliance report %q", c.String())
+	}
+	entry.Keys = entry.Keys[:1]
+	if s := policy.Compliance(entry, now).String(); s != "rochacon: 1 key(s), compliant" {
+		t.Errorf("unexpected compliance report %q", s)
+	}
+}
@@ -0,0 +1,151 @@
+package user
+
+import (
+	"fmt"
+	"time"
+)
+
+// Account actions
+const (
+	AccountExpire = "expire"
+	AccountLock   = "lock"
+	AccountUnlock = "unlock"
+)
+
+// LockPolicy decides which users accounts are locked from their directory
+// credentials state, so users kept on synced groups but otherwise disabled
+// can't login
+type LockPolicy struct {
+	// InactiveKeys locks users whose SSH public keys and access keys are all inactive
+	InactiveKeys bool
+	// StaleAfter locks users that haven't used their password nor access
+	// keys for this long, since their creation if never used, zero disables it
+	StaleAfter time.Duration
+}
+
+// Empty checks wether the policy never locks users
+func (p *LockPolicy) Empty() bool {
+	return p == nil || (!p.InactiveKeys && p.StaleAfter == 0)
+}
+
+// LockReason returns why an user account must be locked, empty if it must not
+func (p *LockPolicy) LockReason(dir Directory, iamUsername string, now time.Time) (string, error) {
+	if p.Empty() {
+		return "", nil
+	}
+	activity, err := dir.UserActivity(iamUsername, p.StaleAfter > 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve user %q activity: %s", iamUsername, err)
+	}
+	if p.InactiveKeys {
+		keys, err := dir.SSHPublicKeys(iamUsername)
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve user %q SSH public keys: %s", iamUsername, err)
+		}
+		active := activity.ActiveAccessKeys
+		for _, key := range keys {
+			if key.Active() {
+				active++
+			}
+		}
+		if len(keys)+activity.AccessKeys > 0 && active == 0 {
+			return "all SSH public keys and access keys are inactive", nil
+		}
+	}
+	if p.StaleAfter > 0 {
+		lastUsed, since := activity.LastUsed, "last used"
+		if lastUsed.IsZero() {
+			lastUsed, since = activity.Created, "never used, created"
+		}
+		if !lastUsed.IsZero() && now.Sub(lastUsed) > p.StaleAfter {
+			return fmt.Sprintf("password and access keys %s on %s", since, lastUsed.UTC().Format("2006-01-02")), nil
+		}
+	}
+	return "", nil
+}
+
+// LockReasons computes the users lock reasons concurrently, see LockReason,
+// errors are returned per user
+func (p *LockPolicy) LockReasons(dir Directory, iamUsernames []string, now time.Time) ([]string, []error) {
+	reasons := make([]string, len(iamUsernames))
+	errs := make([]error, len(iamUsernames))
+	if p.Empty() {
+		return reasons, errs
+	}
+	parallel(directoryWorkers(dir), len(iamUsernames), func(i int) error {
+		reasons[i], errs[i] = p.LockReason(dir, iamUsernames[i], now)
+		return nil
+	})
+	return reasons, errs
+}
+
+// AccountChange describes an user account being locked, unlocked or having its expiration date changed
+type AccountChange struct {
+	Action string `json:"action"`
+	// Expires is the account expiration date set, also when unlocking, zero clears it
+	Expires  time.Time `json:"expires"`
+	Reason   string    `json:"reason,omitempty"`
+	User     *User     `json:"-"`
+	Username string    `json:"username"`
+}
+
+// Apply executes the account change on the system
+func (c *AccountChange) Apply() error {
+	switch c.Action {
+	case AccountLock:
+		return c.User.Lock()
+	case AccountUnlock:
+		// unlocking clears the expiration, restore the desired one
+		if err := c.User.Unlock(); err != nil || c.Expires.IsZero() {
+			return err
+		}
+	}
+	if err := ensureManaged(c.Username); err != nil {
+		return err
+	}
+	err := System.SetExpiry(c.Username, c.Expires)
+	if err != nil {
+		return fmt.Errorf("failed to set user %q expiration: %s", c.Username, err)
+	}
+	return nil
+}
+
+// String describes the change, e.g. for the journal
+func (c *AccountChange) String() string {
+	switch {
+	case c.Action == AccountLock:
+		return "lock account"
+	case c.Action == AccountUnlock && c.Expires.IsZero():
+		return "unlock account"
+	case c.Action == AccountUnlock:
+		return fmt.Sprintf("unlock account, expiring on %s", c.Expires.Format("2006-01-02"))
+	case c.Expires.IsZero():
+		return "clear account expiration"
+	}
+	return fmt.Sprintf("set account expiration to %s", c.Expires.Format("2006-01-02"))
+}
+
+// newAccountChange computes the change making the current account lock and
+// expiration match the desired ones, nil if they already do
+func newAccountChange(desired, current *User) *AccountChange {
+	c := &AccountChange{Expires: desired.Expires, User: desired, Username: desired.Username}
+	switch {
+	case desired.Locked != "" && current.Locked == "":
+		c.Action, c.Reason = AccountLock, desired.Locked
+	case desired.Locked == "" && current.Locked != "":
+		c.Action, c.Reason = AccountUnlock, "AWS IAM signals cleared"
+	case desired.Locked == "" && !sameDay(desired.Expires, current.Expires):
+		c.Action, c.Reason = AccountExpire, fmt.Sprintf("%s tag changed", TagExpires)
+	default:
+		return nil
+	}
+	return c
+}
+
+// sameDay compares expiration dates, which are stored in days
+func sameDay(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return a.IsZero() == b.IsZero()
+	}
+	return a.UTC().Format("2006-01-02") == b.UTC().Format("2006-01-02")
+}
@@ -0,0 +1,125 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockPolicyLockReason(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	dir := &FileDirectory{
+		Users: map[string]*FileDirectoryUser{
+			"active": &FileDirectoryUser{
+				Activity:      &Activity{AccessKeys: 1, ActiveAccessKeys: 1, LastUsed: now.Add(-time.Hour)},
+				SSHPublicKeys: []string{"ssh-ed25519 AAAA"},
+			},
+			"inactive": &FileDirectoryUser{
+				Activity: &Activity{AccessKeys: 2, LastUsed: now.Add(-time.Hour)},
+			},
+			"stale": &FileDirectoryUser{
+				Activity: &Activity{Created: now.Add(-72 * time.Hour), LastUsed: now.Add(-48 * time.Hour)},
+			},
+			"never-used": &FileDirectoryUser{
+				Activity: &Activity{Created: now.Add(-48 * time.Hour)},
+			},
+			"unknown": &FileDirectoryUser{},
+		},
+	}
+	policy := &LockPolicy{InactiveKeys: true, StaleAfter: 24 * time.Hour}
+	cases := map[string]string{
+		"active":     "",
+		"inactive":   "all SSH public keys and access keys are inactive",
+		"stale":      "password and access keys last used on 2019-05-30",
+		"never-used": "password and access keys never used, created on 2019-05-30",
+		"unknown":    "",
+	}
+	for username, expected := range cases {
+		reason, err := policy.LockReason(dir, username, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != expected {
+			t.Errorf("unexpected lock reason for %q: got %q expected %q", username, reason, expected)
+		}
+	}
+	reasons, errs := policy.LockReasons(dir, []string{"active", "inactive"}, now)
+	if len(reasons) != 2 || reasons[0] != "" || reasons[1] != cases["inactive"] || errs[0] != nil || errs[1] != nil {
+		t.Errorf("unexpected lock reasons %q, %v", reasons, errs)
+	}
+	var empty *LockPolicy
+	if reason, err := empty.LockReason(dir, "inactive", now); err != nil || reason != "" {
+		t.Errorf("expected empty policy to never lock, got %q %v", reason, err)
+	}
+}
+
+func TestNewPlanAccounts(t *testing.T) {
+	expires := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	iamUsers := Users{
+		&User{Username: "expiring", Expires: expires},
+		&User{Username: "locked", Locked: "all SSH public keys and access keys are inactive"},
+		&User{Username: "new", Expires: expires},
+		&User{Username: "restored"},
+		&User{Username: "unchanged", Expires: expires},
+	}
+	sysUsers := Users{
+		&User{Username: "expiring"},
+		&User{Username: "locked"},
+		&User{Username: "restored", Locked: "locked on the system", Expires: time.Unix(86400, 0)},
+		&User{Username: "unchanged", Expires: expires},
+	}
+	plan := NewPlan(iamUsers, sysUsers)
+	expected := map[string]string{
+		"expiring": "set account expiration to 2026-12-31",
+		"locked":   "lock account",
+		"new":      "set account expiration to 2026-12-31",
+		"restored": "unlock account",
+	}
+	if len(plan.Accounts) != len(expected) {
+		t.Fatalf("unexpected account changes %#v", plan.Accounts)
+	}
+	for _, c := range plan.Accounts {
+		if c.String() != expected[c.Username] {
+			t.Errorf("unexpected account change for %q: got %q expected %q", c.Username, c, expected[c.Username])
+		}
+	}
+	if !strings.Contains(plan.String(), "~ lock account of user \"locked\": all SSH public keys and access keys are inactive\n") {
+		t.Errorf("unexpected plan:\n%s", plan)
+	}
+}
+
+func TestAccountChangeApply(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	err := f.AddUser(&Account{Gecos: managedGecos, Name: "rochacon", Shell: ToolboxShell, UID: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Username: "rochacon"}
+	expires := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	changes := []*AccountChange{
+		&AccountChange{Action: AccountExpire, Expires: expires},
+		&AccountChange{Action: AccountLock},
+		&AccountChange{Action: AccountUnlock, Expires: expires},
+	}
+	checks := []ShadowEntry{
+		{Expires: expires},
+		{Expires: time.Unix(86400, 0).UTC(), Locked: true},
+		{Expires: expires},
+	}
+	for i, c := range changes {
+		c.User, c.Username = u, u.Username
+		if err = c.Apply(); err != nil {
+			t.Fatal(err)
+		}
+		shadow, err := f.LookupShadow("rochacon")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shadow.Locked != checks[i].Locked || !shadow.Expires.Equal(checks[i].Expires) {
+			t.Errorf("unexpected shadow entry after %s: %#v", c, shadow)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	osuser "os/user"
+	"sync"
+	"time"
+)
+
+// ownersTTL is how long the owners out of a listing of all directories users
+// are reused, so the listings of a sync share them
+const ownersTTL = time.Minute
+
+// Conflict policies for usernames found on several directories
+const (
+	// ConflictError fails the lookups of duplicate usernames
+	ConflictError = "error"
+	// ConflictFirst resolves duplicate usernames to the first directory holding them
+	ConflictFirst = "first"
+	// ConflictSkip ignores duplicate usernames on all directories
+	ConflictSkip = "skip"
+)
+
+// owners values of usernames without a single owner directory
+const (
+	// ownerSkip marks usernames ignored by the ConflictSkip policy
+	ownerSkip = -1
+	// ownerConflict marks usernames failing lookups by the ConflictError policy
+	ownerConflict = -2
+)
+
+// MultiDirectory merges several directories, e.g. AWS IAM accounts, into a
+// single user set. Each username is owned by a single directory, chosen by
+// the conflict policy when it is found on several of them.
+type MultiDirectory struct {
+	Directories []Directory
+	Policy      string
+
+	// owners caches the directory index owning each username, rebuilt out
+	// of all directories users once loaded is older than ownersTTL
+	owners  map[string]int
+	loaded  time.Time
+	mutex   sync.Mutex
+	loading sync.Mutex
+}
+
+// NewMultiDirectory instantiates a MultiDirectory, directories order matters for the ConflictFirst policy
+func NewMultiDirectory(policy string, dirs ...Directory) (*MultiDirectory, error) {
+	switch policy {
+	case ConflictError, ConflictFirst, ConflictSkip:
+	default:
+		return nil, fmt.Errorf("Invalid conflict policy %q, must be error, first or skip.", policy)
+	}
+	return &MultiDirectory{Directories: dirs, Policy: policy}, nil
+}
+
+// GroupMembers lists the users belonging to a group on any directory, the
+// group must exist on at least one of them
+func (d *MultiDirectory) GroupMembers(group string) ([]*Identity, error) {
+	identities := []*Identity{}
+	if err := d.loadOwners(); err != nil {
+		return identities, err
+	}
+	found := false
+	for i, dir := range d.Directories {
+		members, err := dir.GroupMembers(group)
+		if err != nil {
+			if _, ok := err.(osuser.UnknownGroupError); ok {
+				continue
+			}
+			return identities, err
+		}
+		found = true
+		owned, err := d.owned(i, members)
+		if err != nil {
+			return identities, err
+		}
+		identities = append(identities, owned...)
+	}
+	if !found {
+		return identities, osuser.UnknownGroupError(group)
+	}
+	return identities, nil
+}
+
+// ListUsers lists the users under a path prefix on all directories
+func (d *MultiDirectory) ListUsers(pathPrefix string) ([]*Identity, error) {
+	identities := []*Identity{}
+	if err := d.loadOwners(); err != nil {
+		return identities, err
+	}
+	for i, dir := range d.Directories {
+		users, err := dir.ListUsers(pathPrefix)
+		if err != nil {
+			return identities, err
+		}
+		owned, err := d.owned(i, users)
+		if err != nil {
+			return identities, err
+		}
+		identities = append(identities, owned...)
+	}
+	return identities, nil
+}
+
+// ConcurrentCalls returns the largest number of concurrent calls allowed by the directories
+func (d *MultiDirectory) ConcurrentCalls() int {
+	workers := 1
+	for _, dir := range d.Directories {
+		if n := directoryWorkers(dir); n > workers {
+			workers = n
+		}
+	}
+	return workers
+}
+
+// Owner returns the directory owning an username, according to the conflict
+// policy, nil if none does
+func (d *MultiDirectory) Owner(username string) (Directory, error) {
+	i, err := d.owner(username)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	return d.Directories[i], nil
+}
+
+// SSHPublicKeys lists an user SSH public keys from its owner directory
+func (d *MultiDirectory) SSHPublicKeys(username string) ([]*SSHPublicKey, error) {
+	i, err := d.owner(username)
+	if err != nil || i < 0 {
+		return []*SSHPublicKey{}, err
+	}
+	return d.Directories[i].SSHPublicKeys(username)
+}
+
+// User retrieves an user from its owner directory, or nil if it has none
+func (d *MultiDirectory) User(username string) (*Identity, error) {
+	i, err := d.owner(username)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	return d.Directories[i].User(username)
+}
+
+// UserActivity retrieves an user credentials state and usage from its owner directory
+func (d *MultiDirectory) UserActivity(username string, lastUsed bool) (*Activity, error) {
+	i, err := d.owner(username)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return &Activity{}, nil
+	}
+	return d.Directories[i].UserActivity(username, lastUsed)
+}
+
+// UserGroups lists the groups an user belongs to on its owner directory
+func (d *MultiDirectory) UserGroups(username string) ([]string, error) {
+	i, err := d.owner(username)
+	if err != nil || i < 0 {
+		return []string{}, err
+	}
+	return d.Directories[i].UserGroups(username)
+}
+
+// UserTags retrieves an user tags from its owner directory
+func (d *MultiDirectory) UserTags(username string) (map[string]string, error) {
+	i, err := d.owner(username)
+	if err != nil || i < 0 {
+		return map[string]string{}, err
+	}
+	return d.Directories[i].UserTags(username)
+}
+
+// loadOwners caches the directory owning each username, according to the
+// conflict policy, out of a listing of all directories users. Listings are
+// reused for ownersTTL, concurrent calls wait for the same listing.
+func (d *MultiDirectory) loadOwners() error {
+	d.loading.Lock()
+	defer d.loading.Unlock()
+	d.mutex.Lock()
+	fresh := d.owners != nil && time.Since(d.loaded) < ownersTTL
+	d.mutex.Unlock()
+	if fresh {
+		return nil
+	}
+	holders := map[string][]int{}
+	for i, dir := range d.Directories {
+		users, err := dir.ListUsers("/")
+		if err != nil {
+			return err
+		}
+		for _, identity := range users {
+			holders[identity.Username] = append(holders[identity.Username], i)
+		}
+	}
+	owners := map[string]int{}
+	for username, dirs := range holders {
+		owners[username] = d.resolve(dirs)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.owners, d.loaded = owners, time.Now()
+	return nil
+}
+
+// resolve picks the owner of an username out of the directories holding it
+func (d *MultiDirectory) resolve(dirs []int) int {
+	switch {
+	case len(dirs) == 1 || d.Policy == ConflictFirst:
+		return dirs[0]
+	case d.Policy == ConflictError:
+		return ownerConflict
+	default:
+		return ownerSkip
+	}
+}
+
+// owned filters the identities listed by the i-th directory down to the
+// ones it owns, see owner
+func (d *MultiDirectory) owned(i int, identities []*Identity) ([]*Identity, error) {
+	owned := []*Identity{}
+	for _, identity := range identities {
+		owner, err := d.owner(identity.Username)
+		if err != nil {
+			return owned, err
+		}
+		if owner == i {
+			owned = append(owned, identity)
+		}
+	}
+	return owned, nil
+}
+
+// owner returns the index of the directory holding an username, according
+// to the conflict policy, or -1 if none does. Cached owners are reused,
+// others are looked up on every directory.
+func (d *MultiDirectory) owner(username string) (int, error) {
+	d.mutex.Lock()
+	owner, ok := d.owners[username]
+	d.mutex.Unlock()
+	if !ok {
+		holders := []int{}
+		for i, dir := range d.Directories {
+			identity, err := dir.User(username)
+			if err != nil {
+				return -1, err
+			}
+			if identity != nil {
+				holders = append(holders, i)
+			}
+		}
+		if len(holders) == 0 {
+			return -1, nil
+		}
+		owner = d.resolve(holders)
+		d.mutex.Lock()
+		if d.owners == nil {
+			d.owners = map[string]int{}
+		}
+		d.owners[username] = owner
+		d.mutex.Unlock()
+	}
+	switch owner {
+	case ownerConflict:
+		return -1, fmt.Errorf("username %q found on several directories", username)
+	case ownerSkip:
+		log.Printf("Skipping username %q, found on several directories", username)
+		return -1, nil
+	}
+	return owner, nil
+}
@@ -0,0 +1,105 @@
+package user
+
+import (
+	osuser "os/user"
+	"testing"
+)
+
+func newTestMultiDirectory(t *testing.T, policy string) *MultiDirectory {
+	central := newFakeIAM(10)
+	central.groups["bastrd"] = []string{"alice", "bob"}
+	central.keys["alice"] = []string{"ssh-ed25519 AAAA central"}
+	other := newFakeIAM(10)
+	other.groups["bastrd"] = []string{"alice", "carol"}
+	other.groups["other"] = []string{"carol"}
+	other.keys["alice"] = []string{"ssh-ed25519 AAAA other"}
+	dir, err := NewMultiDirectory(policy, NewIAMDirectory(central), NewIAMDirectory(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMultiDirectoryConflictPolicies(t *testing.T) {
+	dir := newTestMultiDirectory(t, ConflictFirst)
+	members, err := dir.GroupMembers("bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Errorf("expected merged group members, got %d", len(members))
+	}
+	keys, err := dir.SSHPublicKeys("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Body != "ssh-ed25519 AAAA central" {
+		t.Errorf("expected duplicate user keys from the first directory, got %#v", keys)
+	}
+	if members, err = dir.GroupMembers("other"); err != nil || len(members) != 1 {
+		t.Errorf("expected groups missing on some directories to be found, got %#v: %v", members, err)
+	}
+	if _, err = dir.GroupMembers("missing"); err == nil {
+		t.Error("expected groups missing on all directories to fail")
+	} else if _, ok := err.(osuser.UnknownGroupError); !ok {
+		t.Errorf("expected an UnknownGroupError, got %s", err)
+	}
+
+	dir = newTestMultiDirectory(t, ConflictSkip)
+	members, err = dir.GroupMembers("bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].Username != "bob" || members[1].Username != "carol" {
+		t.Errorf("expected duplicate usernames to be skipped, got %#v", members)
+	}
+	if keys, err = dir.SSHPublicKeys("alice"); err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys for duplicate usernames, got %#v: %v", keys, err)
+	}
+
+	dir = newTestMultiDirectory(t, ConflictError)
+	if _, err = dir.GroupMembers("bastrd"); err == nil {
+		t.Error("expected duplicate usernames to fail")
+	}
+	if _, err = NewMultiDirectory("last"); err == nil {
+		t.Error("expected invalid conflict policy to fail")
+	}
+}
+
+func TestMultiDirectoryOwnersLookups(t *testing.T) {
+	central := newFakeIAM(10)
+	central.groups["bastrd"] = []string{"alice", "bob"}
+	other := newFakeIAM(10)
+	other.groups["bastrd"] = []string{"alice", "carol"}
+	dir, err := NewMultiDirectory(ConflictFirst, NewIAMDirectory(central), NewIAMDirectory(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := dir.GroupMembers("bastrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Errorf("expected merged group members, got %#v", members)
+	}
+	if _, err = dir.UserTags("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dir.GroupMembers("bastrd"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fake := range []*fakeIAM{central, other} {
+		if fake.calls["GetUser"] != 0 || fake.calls["ListUsers"] != 1 {
+			t.Errorf("expected owners from a single listing, got calls %v", fake.calls)
+		}
+	}
+	if owner, err := dir.Owner("carol"); err != nil || owner != dir.Directories[1] {
+		t.Errorf("expected carol to be owned by the second directory, got %v, %v", owner, err)
+	}
+	if _, err = dir.User("dave"); err != nil {
+		t.Fatal(err)
+	}
+	if central.calls["GetUser"] != 1 || other.calls["GetUser"] != 1 {
+		t.Errorf("expected unknown usernames to be looked up, got calls %v and %v", central.calls, other.calls)
+	}
+}
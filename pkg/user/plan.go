@@ -0,0 +1,259 @@
+package user
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rochacon/bastrd/pkg/sudoers"
+)
+
+// Membership actions
+const (
+	MembershipAdd    = "add"
+	MembershipRemove = "remove"
+)
+
+// Plan describes the changes required to mirror a Users collection, usually
+// from AWS IAM, into another, usually from the system
+type Plan struct {
+	// Managed is the number of users currently managed
+	Managed int   `json:"managed"`
+	Create  Users `json:"create"`
+	Remove  Users `json:"remove"`
+	// Recreated are usernames whose AWS IAM user was re-created with a new
+	// UserId, the previous accounts are removed first, filled by the caller
+	Recreated []string `json:"recreated"`
+	// Restore are users pending removal that are desired again, filled by the caller
+	Restore     Users               `json:"restore"`
+	Memberships []*MembershipChange `json:"memberships"`
+	Shells      []*ShellChange      `json:"shells"`
+	// Accounts are accounts locks and expiration dates changes
+	Accounts []*AccountChange `json:"accounts"`
+	// Sudoers are the managed sudoers files changes, filled by the caller
+	Sudoers []*sudoers.Change `json:"sudoers"`
+	// Unmanaged are usernames of system accounts not created by bastrd, which are left untouched
+	Unmanaged []string `json:"unmanaged"`
+	// Homes are existing users whose home directory templates are
+	// re-applied, files edited by the users are kept, filled by the caller
+	Homes Users `json:"homes"`
+	// Keys are AWS IAM usernames of the desired users, whose SSH public keys
+	// are cached and checked against the key policy, filled by the caller
+	Keys []string `json:"-"`
+}
+
+// MembershipChange describes an user being added or removed from a group
+type MembershipChange struct {
+	Action    string `json:"action"`
+	Group     *Group `json:"-"`
+	User      *User  `json:"-"`
+	Username  string `json:"username"`
+	Groupname string `json:"group"`
+}
+
+// ShellChange describes an user login shell update
+type ShellChange struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	User     *User  `json:"-"`
+	Username string `json:"username"`
+}
+
+// NewPlan computes the changes required to make current look like desired
+func NewPlan(desired, current Users) *Plan {
+	plan := &Plan{
+		Managed:     len(current),
+		Create:      desired.Diff(current),
+		Remove:      current.Diff(desired),
+		Recreated:   []string{},
+		Restore:     Users{},
+		Homes:       Users{},
+		Keys:        []string{},
+		Memberships: []*MembershipChange{},
+		Shells:      []*ShellChange{},
+		Accounts:    []*AccountChange{},
+		Sudoers:     []*sudoers.Change{},
+		Unmanaged:   []string{},
+	}
+	for _, u := range desired {
+		sysUser := current.Get(u.Username)
+		if sysUser == nil {
+			// new accounts are unlocked and never expire
+			if c := newAccountChange(u, &User{Username: u.Username}); c != nil {
+				plan.Accounts = append(plan.Accounts, c)
+			}
+			continue
+		}
+		if c := newAccountChange(u, sysUser); c != nil {
+			plan.Accounts = append(plan.Accounts, c)
+		}
+		for _, g := range u.GroupsDiff(sysUser) {
+			plan.Memberships = append(plan.Memberships, newMembershipChange(MembershipAdd, u, g))
+		}
+		for _, g := range sysUser.GroupsDiff(u) {
+			plan.Memberships = append(plan.Memberships, newMembershipChange(MembershipRemove, u, g))
+		}
+		if u.Shell != "" && sysUser.Shell != "" && u.Shell != sysUser.Shell {
+			plan.Shells = append(plan.Shells, &ShellChange{
+				From:     sysUser.Shell,
+				To:       u.Shell,
+				User:     u,
+				Username: u.Username,
+			})
+		}
+	}
+	return plan
+}
+
+// SkipUnmanaged drops the changes touching existing system accounts not created by bastrd
+func (p *Plan) SkipUnmanaged() error {
+	unmanaged := map[string]bool{}
+	check := func(username string) (bool, error) {
+		skip, ok := unmanaged[username]
+		if ok {
+			return skip, nil
+		}
+		isManaged, err := Managed(username)
+		if err != nil {
+			return false, fmt.Errorf("failed to check user %q account: %s", username, err)
+		}
+		unmanaged[username] = !isManaged
+		if !isManaged {
+			p.Unmanaged = append(p.Unmanaged, username)
+		}
+		return !isManaged, nil
+	}
+	filter := func(users Users) (Users, error) {
+		kept := Users{}
+		for _, u := range users {
+			skip, err := check(u.Username)
+			if err != nil {
+				return nil, err
+			}
+			if !skip {
+				kept = append(kept, u)
+			}
+		}
+		return kept, nil
+	}
+	var err error
+	if p.Create, err = filter(p.Create); err != nil {
+		return err
+	}
+	if p.Remove, err = filter(p.Remove); err != nil {
+		return err
+	}
+	if p.Restore, err = filter(p.Restore); err != nil {
+		return err
+	}
+	memberships := []*MembershipChange{}
+	for _, m := range p.Memberships {
+		skip, err := check(m.Username)
+		if err != nil {
+			return err
+		}
+		if !skip {
+			memberships = append(memberships, m)
+		}
+	}
+	p.Memberships = memberships
+	shells := []*ShellChange{}
+	for _, c := range p.Shells {
+		skip, err := check(c.Username)
+		if err != nil {
+			return err
+		}
+		if !skip {
+			shells = append(shells, c)
+		}
+	}
+	p.Shells = shells
+	accounts := []*AccountChange{}
+	for _, c := range p.Accounts {
+		skip, err := check(c.Username)
+		if err != nil {
+			return err
+		}
+		if !skip {
+			accounts = append(accounts, c)
+		}
+	}
+	p.Accounts = accounts
+	return nil
+}
+
+// Empty checks wether the plan has no changes
+func (p *Plan) Empty() bool {
+	return len(p.Create) == 0 && len(p.Remove) == 0 && len(p.Restore) == 0 && len(p.Memberships) == 0 && len(p.Shells) == 0 && len(p.Accounts) == 0 && len(p.Sudoers) == 0
+}
+
+// String renders a human readable description of the plan
+func (p *Plan) String() string {
+	if p.Empty() && len(p.Unmanaged) == 0 && len(p.Homes) == 0 {
+		return "No changes.\n"
+	}
+	buf := &bytes.Buffer{}
+	for _, u := range p.Create {
+		fmt.Fprintf(buf, "+ create user %q (uid %d, shell %q, groups %s)\n", u.Username, u.UID, u.Shell, groupNames(u.Groups))
+	}
+	for _, u := range p.Remove {
+		if stringIn(u.Username, p.Recreated) {
+			fmt.Fprintf(buf, "- remove user %q, its AWS IAM user was re-created\n", u.Username)
+			continue
+		}
+		fmt.Fprintf(buf, "- remove user %q\n", u.Username)
+	}
+	for _, u := range p.Restore {
+		fmt.Fprintf(buf, "~ restore user %q\n", u.Username)
+	}
+	for _, m := range p.Memberships {
+		if m.Action == MembershipAdd {
+			fmt.Fprintf(buf, "+ add user %q to group %q\n", m.Username, m.Groupname)
+		} else {
+			fmt.Fprintf(buf, "- remove user %q from group %q\n", m.Username, m.Groupname)
+		}
+	}
+	for _, s := range p.Shells {
+		fmt.Fprintf(buf, "~ change user %q shell from %q to %q\n", s.Username, s.From, s.To)
+	}
+	for _, c := range p.Accounts {
+		fmt.Fprintf(buf, "~ %s of user %q: %s\n", c, c.Username, c.Reason)
+	}
+	for _, u := range p.Homes {
+		fmt.Fprintf(buf, "~ re-apply home directory templates of user %q\n", u.Username)
+	}
+	for _, c := range p.Sudoers {
+		switch c.Action {
+		case sudoers.ActionInstall:
+			fmt.Fprintf(buf, "+ %s\n", c)
+		case sudoers.ActionRemove:
+			fmt.Fprintf(buf, "- %s\n", c)
+		default:
+			fmt.Fprintf(buf, "~ %s\n", c)
+		}
+	}
+	for _, username := range p.Unmanaged {
+		fmt.Fprintf(buf, "! skip user %q, its account was not created by bastrd\n", username)
+	}
+	fmt.Fprintf(buf, "Plan: %d to create, %d to remove, %d membership changes, %d shell changes.\n", len(p.Create), len(p.Remove), len(p.Memberships), len(p.Shells))
+	return buf.String()
+}
+
+// newMembershipChange builds a MembershipChange for an user and group
+func newMembershipChange(action string, u *User, g *Group) *MembershipChange {
+	return &MembershipChange{
+		Action:    action,
+		Group:     g,
+		Groupname: g.Name,
+		User:      u,
+		Username:  u.Username,
+	}
+}
+
+// groupNames formats a list of group names
+func groupNames(groups []*Group) string {
+	names := []string{}
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return fmt.Sprintf("%q", names)
+}
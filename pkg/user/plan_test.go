@@ -0,0 +1,77 @@
+package user
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rochacon/bastrd/pkg/sudoers"
+)
+
+func TestNewPlan(t *testing.T) {
+	admins := &Group{Name: "admins"}
+	bastrd := &Group{Name: "bastrd"}
+	iamUsers := Users{
+		&User{Username: "rochacon", Shell: ToolboxShell, Groups: []*Group{bastrd, admins}},
+		&User{Username: "newcomer", Shell: ToolboxShell, Groups: []*Group{bastrd}},
+	}
+	sysUsers := Users{
+		&User{Username: "rochacon", Shell: HostShell, Groups: []*Group{bastrd}},
+		&User{Username: "leaver", Shell: ToolboxShell, Groups: []*Group{bastrd, admins}},
+	}
+	plan := NewPlan(iamUsers, sysUsers)
+	if len(plan.Create) != 1 || plan.Create[0].Username != "newcomer" {
+		t.Errorf("expected user \"newcomer\" to be created, got %#v", plan.Create)
+	}
+	if len(plan.Remove) != 1 || plan.Remove[0].Username != "leaver" {
+		t.Errorf("expected user \"leaver\" to be removed, got %#v", plan.Remove)
+	}
+	if len(plan.Memberships) != 1 || plan.Memberships[0].Action != MembershipAdd || plan.Memberships[0].Groupname != "admins" {
+		t.Errorf("expected user \"rochacon\" to be added to \"admins\", got %#v", plan.Memberships)
+	}
+	if len(plan.Shells) != 1 || plan.Shells[0].From != HostShell || plan.Shells[0].To != ToolboxShell {
+		t.Errorf("expected user \"rochacon\" shell to change, got %#v", plan.Shells)
+	}
+	if !strings.Contains(plan.String(), "Plan: 1 to create, 1 to remove, 1 membership changes, 1 shell changes.") {
+		t.Errorf("unexpected plan summary: %s", plan)
+	}
+	if _, err := json.Marshal(plan); err != nil {
+		t.Errorf("failed to encode plan as JSON: %s", err)
+	}
+}
+
+func TestNewPlanWhenInSync(t *testing.T) {
+	users := Users{
+		&User{Username: "rochacon", Shell: ToolboxShell, Groups: []*Group{&Group{Name: "bastrd"}}},
+	}
+	plan := NewPlan(users, users)
+	if !plan.Empty() {
+		t.Errorf("expected empty plan, got %#v", plan)
+	}
+	if plan.String() != "No changes.\n" {
+		t.Errorf("unexpected empty plan description: %q", plan)
+	}
+}
+
+func TestPlanSudoersChanges(t *testing.T) {
+	plan := NewPlan(Users{}, Users{})
+	plan.Sudoers = []*sudoers.Change{
+		{Action: sudoers.ActionInstall, File: "bastrd-ops", Group: "ops"},
+		{Action: sudoers.ActionRemove, File: "bastrd-old"},
+	}
+	if plan.Empty() {
+		t.Errorf("expected plan with sudoers changes not to be empty")
+	}
+	expected := "+ install sudoers file \"bastrd-ops\" for group \"ops\"\n- remove sudoers file \"bastrd-old\"\n"
+	if !strings.Contains(plan.String(), expected) {
+		t.Errorf("unexpected plan description: %s", plan)
+	}
+}
+
+func TestPlanHomes(t *testing.T) {
+	plan := NewPlan(Users{}, Users{})
+	plan.Homes = Users{&User{Username: "rochacon"}}
+	if plan.String() != "~ re-apply home directory templates of user \"rochacon\"\nPlan: 0 to create, 0 to remove, 0 membership changes, 0 shell changes.\n" {
+		t.Errorf("unexpected plan description: %q", plan)
+	}
+}
@@ -0,0 +1,80 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"strconv"
+	"strings"
+)
+
+// LoginDefsPath is the shadow-utils configuration holding UID_MIN
+const LoginDefsPath = "/etc/login.defs"
+
+var (
+	// ReservedUsernames are never synced, regardless of their uid
+	ReservedUsernames = []string{"root", "core", "ec2-user"}
+	// ReservedUIDMin reserves the existing system accounts with lower uids, usually login.defs UID_MIN
+	ReservedUIDMin uint32 = 1000
+)
+
+// Reserved checks wether an username belongs to a system account that must never be synced
+func Reserved(username string) bool {
+	if stringIn(username, ReservedUsernames) {
+		return true
+	}
+	account, err := System.LookupUser(username)
+	return err == nil && account.UID < ReservedUIDMin
+}
+
+// ReadUIDMin reads UID_MIN from a login.defs file, defaulting to 1000 if unset or if the file doesn't exist
+func ReadUIDMin(path string) (uint32, error) {
+	uidMin := uint32(1000)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return uidMin, nil
+		}
+		return uidMin, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "UID_MIN" {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return uidMin, fmt.Errorf("invalid UID_MIN %q in %q", fields[1], path)
+		}
+		uidMin = uint32(n)
+	}
+	return uidMin, scanner.Err()
+}
+
+// Managed checks wether an user either doesn't exist on the system or was
+// created by bastrd, as recorded on its account GECOS
+func Managed(username string) (bool, error) {
+	account, err := System.LookupUser(username)
+	if err != nil {
+		if _, ok := err.(osuser.UnknownUserError); ok {
+			return true, nil
+		}
+		return false, err
+	}
+	return strings.SplitN(account.Gecos, ",", 2)[0] == managedGecos, nil
+}
+
+// ensureManaged refuses to touch system accounts not created by bastrd
+func ensureManaged(username string) error {
+	isManaged, err := Managed(username)
+	if err != nil {
+		return fmt.Errorf("failed to check user %q account: %s", username, err)
+	}
+	if !isManaged {
+		return fmt.Errorf("refusing to modify user %q, its account was not created by bastrd", username)
+	}
+	return nil
+}
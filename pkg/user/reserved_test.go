@@ -0,0 +1,72 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadUIDMin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd-login-defs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "login.defs")
+	if uidMin, err := ReadUIDMin(path); err != nil || uidMin != 1000 {
+		t.Errorf("expected missing login.defs to default to 1000, got %d: %v", uidMin, err)
+	}
+	content := "# UID_MIN 1\nMAIL_DIR /var/mail\nUID_MIN\t\t\t  500\nUID_MAX 60000\n"
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if uidMin, err := ReadUIDMin(path); err != nil || uidMin != 500 {
+		t.Errorf("expected UID_MIN 500, got %d: %v", uidMin, err)
+	}
+}
+
+func TestReservedAndManaged(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	accounts := []*Account{
+		&Account{Gecos: "", Home: "/var/lib/syslog", Name: "syslog", UID: 104},
+		&Account{Gecos: "Ubuntu", Home: "/home/ubuntu", Name: "ubuntu", UID: 1000},
+		&Account{Gecos: managedAccountGecos("rochacon"), Home: "/home/rochacon", Name: "rochacon", UID: 2000},
+	}
+	for _, account := range accounts {
+		if err := f.AddUser(account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for username, expected := range map[string]bool{"root": true, "syslog": true, "ubuntu": false, "rochacon": false, "newcomer": false} {
+		if Reserved(username) != expected {
+			t.Errorf("expected user %q reserved to be %t", username, expected)
+		}
+	}
+	for username, expected := range map[string]bool{"ubuntu": false, "rochacon": true, "newcomer": true} {
+		if managed, err := Managed(username); err != nil || managed != expected {
+			t.Errorf("expected user %q managed to be %t, got %t: %v", username, expected, managed, err)
+		}
+	}
+	if err := (&User{Username: "ubuntu"}).Remove(); err == nil {
+		t.Error("expected unmanaged user removal to be refused")
+	}
+
+	bastrd := &Group{Name: "bastrd"}
+	plan := NewPlan(
+		Users{&User{Username: "ubuntu", Groups: []*Group{bastrd}}, &User{Username: "newcomer", Groups: []*Group{bastrd}}},
+		Users{&User{Username: "rochacon", Groups: []*Group{bastrd}}},
+	)
+	if err := plan.SkipUnmanaged(); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Create) != 1 || plan.Create[0].Username != "newcomer" || len(plan.Remove) != 1 {
+		t.Errorf("expected only unmanaged changes to be skipped, got %s", plan)
+	}
+	if len(plan.Unmanaged) != 1 || plan.Unmanaged[0] != "ubuntu" {
+		t.Errorf("expected user \"ubuntu\" to be reported as unmanaged, got %v", plan.Unmanaged)
+	}
+}
@@ -0,0 +1,56 @@
+package user
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Selector chooses AWS IAM users by path prefix and tags
+type Selector struct {
+	// Group is the system group the selected users are members of
+	Group *Group
+	// PathPrefix selects users under an AWS IAM path, e.g. "/engineering/"
+	PathPrefix string
+	// Tags selects users having all the given tags values
+	Tags map[string]string
+}
+
+// ParseTagSelectors parses key=value tag selectors
+func ParseTagSelectors(selectors []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, selector := range selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid tag selector %q, must be key=value.", selector)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// Empty checks wether the selector chooses no users
+func (s *Selector) Empty() bool {
+	return s == nil || (s.PathPrefix == "" && len(s.Tags) == 0)
+}
+
+// Matches checks wether an user path is under the selector path prefix and
+// its tags have all the selector tags values
+func (s *Selector) Matches(path string, tags map[string]string) bool {
+	if !strings.HasPrefix(path, s.pathPrefix()) {
+		return false
+	}
+	for k, v := range s.Tags {
+		if value, ok := tags[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// pathPrefix returns the selector path prefix, defaulting to all users
+func (s *Selector) pathPrefix() string {
+	if s.PathPrefix == "" {
+		return "/"
+	}
+	return s.PathPrefix
+}
@@ -0,0 +1,60 @@
+package user
+
+import (
+	"testing"
+)
+
+func TestParseTagSelectors(t *testing.T) {
+	tags, err := ParseTagSelectors([]string{"team=platform", "env=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 3 || tags["team"] != "platform" || tags["env"] != "a=b" || tags["empty"] != "" {
+		t.Errorf("unexpected tags %#v", tags)
+	}
+	for _, invalid := range []string{"team", "=platform"} {
+		if _, err = ParseTagSelectors([]string{invalid}); err == nil {
+			t.Errorf("expected tag selector %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestFromDirectorySelector(t *testing.T) {
+	svc := newFakeIAM(1)
+	svc.groups["bastrd"] = []string{"member"}
+	svc.paths["member"] = "/sales/"
+	svc.paths["platform"] = "/engineering/"
+	svc.paths["frontend"] = "/engineering/"
+	svc.paths["outsider"] = "/sales/"
+	svc.tags["platform"] = map[string]string{"team": "platform"}
+	svc.tags["frontend"] = map[string]string{"team": "frontend"}
+	svc.tags["outsider"] = map[string]string{"team": "platform"}
+	dir := NewIAMDirectory(svc)
+	bastrd := &Group{Name: "bastrd"}
+	engineering := &Group{Name: "engineering"}
+	selector := &Selector{Group: engineering, PathPrefix: "/engineering/", Tags: map[string]string{"team": "platform"}}
+
+	users, err := FromDirectorySelector(dir, selector, bastrd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users.Get("member") == nil || users.Get("platform") == nil {
+		t.Fatalf("expected group members and selected users, got %#v", users)
+	}
+	if groups := users.Get("platform").Groups; len(groups) != 1 || groups[0] != engineering {
+		t.Errorf("expected selected user to be a member of the selector group, got %#v", groups)
+	}
+	if svc.calls["ListUsers"] != 2 {
+		t.Errorf("expected ListUsers to paginate, got %d calls", svc.calls["ListUsers"])
+	}
+
+	for username, expected := range map[string]int{"platform": 1, "frontend": 0, "outsider": 0, "deleted": 0} {
+		users, err = FromDirectoryUser(dir, username, selector, bastrd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != expected {
+			t.Errorf("expected %d users for %q, got %#v", expected, username, users)
+		}
+	}
+}
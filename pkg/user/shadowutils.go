@@ -0,0 +1,238 @@
+package user
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	osuser "os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shadowUtilsPaths are searched for shadow-utils binaries, in order
+var shadowUtilsPaths = []string{"/usr/sbin", "/sbin", "/usr/bin", "/bin"}
+
+// ShadowUtils is a Backend calling shadow-utils commands, e.g. useradd and gpasswd
+type ShadowUtils struct{}
+
+// AddGroup creates a group, it is a noop if the group already exists
+func (s *ShadowUtils) AddGroup(name string, gid uint32) error {
+	args := []string{"-f"}
+	if gid != 0 {
+		args = append(args, "-g", strconv.FormatUint(uint64(gid), 10))
+	}
+	return s.run("groupadd", append(args, name)...)
+}
+
+// AddGroupMember adds an user to a group supplementary members
+func (s *ShadowUtils) AddGroupMember(group, username string) error {
+	return s.run("gpasswd", "-a", username, group)
+}
+
+// AddUser creates an user with its private group and home directory, password login is disabled.
+// The private group is created first with the user's id, so useradd doesn't pick its gid.
+func (s *ShadowUtils) AddUser(account *Account) error {
+	id := strconv.FormatUint(uint64(account.UID), 10)
+	if err := s.run("groupadd", "-g", id, account.Name); err != nil {
+		return err
+	}
+	args := []string{
+		"-m",
+		"-u", id,
+		"-g", account.Name,
+		"-p", "*", // disable password
+		"-s", account.Shell,
+		"-c", account.Gecos,
+	}
+	if account.Home != "" {
+		args = append(args, "-d", account.Home)
+	}
+	if len(account.Groups) > 0 {
+		args = append(args, "-G", strings.Join(account.Groups, ","))
+	}
+	if err := s.run("useradd", append(args, account.Name)...); err != nil {
+		if delErr := s.run("groupdel", account.Name); delErr != nil {
+			log.Printf("Failed to remove private group %q of user %q: %s", account.Name, account.Name, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteUser removes an user along with its home directory
+func (s *ShadowUtils) DeleteUser(username string) error {
+	return s.run("userdel", "--remove", username)
+}
+
+// IDInUse checks whether an id is used by any user or group
+func (s *ShadowUtils) IDInUse(id uint32) bool {
+	sid := strconv.FormatUint(uint64(id), 10)
+	if _, err := s.getent("passwd", sid); err == nil {
+		return true
+	}
+	if _, err := s.getent("group", sid); err == nil {
+		return true
+	}
+	return false
+}
+
+// LockUser locks the user password and expires the account, so SSH public key logins are denied too
+func (s *ShadowUtils) LockUser(username string) error {
+	return s.run("usermod", "-L", "-e", "1", username)
+}
+
+// LookupGroup retrieves a group entry with getent
+func (s *ShadowUtils) LookupGroup(name string) (*GroupEntry, error) {
+	fields, err := s.getent("group", name)
+	if err != nil {
+		if _, ok := err.(errNotFound); ok {
+			return nil, osuser.UnknownGroupError(name)
+		}
+		return nil, err
+	}
+	return parseGroupEntry(fields)
+}
+
+// LookupShadow retrieves an user password lock and expiration state with getent
+func (s *ShadowUtils) LookupShadow(username string) (*ShadowEntry, error) {
+	fields, err := s.getent("shadow", username)
+	if err != nil {
+		if _, ok := err.(errNotFound); ok {
+			return nil, osuser.UnknownUserError(username)
+		}
+		return nil, err
+	}
+	return parseShadowEntry(fields)
+}
+
+// LookupUser retrieves an user account entry with getent
+func (s *ShadowUtils) LookupUser(username string) (*Account, error) {
+	fields, err := s.getent("passwd", username)
+	if err != nil {
+		if _, ok := err.(errNotFound); ok {
+			return nil, osuser.UnknownUserError(username)
+		}
+		return nil, err
+	}
+	return parsePasswdEntry(fields)
+}
+
+// RemoveGroupMember removes an user from a group supplementary members
+func (s *ShadowUtils) RemoveGroupMember(group, username string) error {
+	return s.run("gpasswd", "-d", username, group)
+}
+
+// SetExpiry sets an user account expiration date, the zero time clears it
+func (s *ShadowUtils) SetExpiry(username string, expires time.Time) error {
+	date := ""
+	if !expires.IsZero() {
+		date = expires.UTC().Format("2006-01-02")
+	}
+	return s.run("usermod", "-e", date, username)
+}
+
+// SetShell changes an user login shell
+func (s *ShadowUtils) SetShell(username, shell string) error {
+	return s.run("usermod", "-s", shell, username)
+}
+
+// UnlockUser unlocks the user password and clears the account expiration
+func (s *ShadowUtils) UnlockUser(username string) error {
+	return s.run("usermod", "-U", "-e", "", username)
+}
+
+// errNotFound is returned by getent when the key does not exist
+type errNotFound string
+
+func (e errNotFound) Error() string {
+	return fmt.Sprintf("%s not found", string(e))
+}
+
+// getent retrieves and splits a database entry
+func (s *ShadowUtils) getent(database, key string) ([]string, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("getent", database, key)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// getent exits with 2 when the key is not found
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return nil, errNotFound(key)
+		}
+		return nil, fmt.Errorf("getent %s %q failed: %s %q", database, key, err, strings.TrimSpace(stderr.String()))
+	}
+	line := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	return strings.Split(line, ":"), nil
+}
+
+// run executes a shadow-utils command, returning its stderr on failure
+func (s *ShadowUtils) run(name string, args ...string) error {
+	path := name
+	for _, dir := range shadowUtilsPaths {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			path = filepath.Join(dir, name)
+			break
+		}
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("call to %s %q failed: %s %q", name, args, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// parsePasswdEntry parses the fields of a passwd line
+func parsePasswdEntry(fields []string) (*Account, error) {
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("unexpected passwd entry: %q", strings.Join(fields, ":"))
+	}
+	uid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q for user %q: %s", fields[2], fields[0], err)
+	}
+	gid, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q for user %q: %s", fields[3], fields[0], err)
+	}
+	return &Account{
+		Gecos: fields[4],
+		GID:   uint32(gid),
+		Home:  fields[5],
+		Name:  fields[0],
+		Shell: fields[6],
+		UID:   uint32(uid),
+	}, nil
+}
+
+// parseGroupEntry parses the fields of a group line
+func parseGroupEntry(fields []string) (*GroupEntry, error) {
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected group entry: %q", strings.Join(fields, ":"))
+	}
+	gid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q for group %q: %s", fields[2], fields[0], err)
+	}
+	return &GroupEntry{
+		GID:     uint32(gid),
+		Members: splitMembers(fields[3]),
+		Name:    fields[0],
+	}, nil
+}
+
+// splitMembers splits a comma separated list of group members
+func splitMembers(s string) []string {
+	members := []string{}
+	for _, m := range strings.Split(s, ",") {
+		if m != "" {
+			members = append(members, m)
+		}
+	}
+	return members
+}
@@ -0,0 +1,220 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultStatePath is the default location of bastrd persistent state
+const DefaultStatePath = "/var/lib/bastrd/state.json"
+
+const (
+	// minID is the first id available for allocation
+	minID = 2000
+	// maxID is the last id available for allocation, right before the nobody/nogroup range
+	maxID = 65533
+)
+
+// State holds bastrd persistent state, e.g. users and groups ids allocations.
+// Users and groups share the same id space, so an user private group can
+// always reuse the user's id as its gid.
+// Allocations are never released, so a removed user uid is never reused
+// by someone else.
+type State struct {
+	UIDs map[string]uint32 `json:"uids"`
+	GIDs map[string]uint32 `json:"gids"`
+	// ExtraGroups holds the system groups granted to each user by tags, so revoked ones can be removed
+	ExtraGroups map[string][]string `json:"extra_groups"`
+	// Locks holds the users locked by the lock policy with the reason, only
+	// these are unlocked by sync, accounts locked by operators are kept locked
+	Locks map[string]string `json:"locks"`
+	// Removals holds the users locked and waiting for the removal grace period
+	Removals map[string]*Removal `json:"removals"`
+	// Users holds the system users managed by sync
+	Users map[string]*ManagedUser `json:"users"`
+	// HomeFiles holds the checksums of the home template files last written for each user
+	HomeFiles map[string]map[string]string `json:"home_files"`
+
+	// inUse checks whether an id is taken by an account not tracked on the state
+	inUse func(id uint32) bool
+	mutex sync.Mutex
+	path  string
+}
+
+// ManagedUser records a system user managed by sync and the AWS IAM user it belongs to
+type ManagedUser struct {
+	Groups      []string `json:"groups"`
+	IAMUserID   string   `json:"iam_user_id,omitempty"`
+	IAMUsername string   `json:"iam_username"`
+	// Since is when sync started managing the user
+	Since time.Time `json:"since"`
+}
+
+// LoadState reads the state from path, an unexistent file results in an empty state
+func LoadState(path string) (*State, error) {
+	s := &State{
+		UIDs:        map[string]uint32{},
+		GIDs:        map[string]uint32{},
+		ExtraGroups: map[string][]string{},
+		Locks:       map[string]string{},
+		Removals:    map[string]*Removal{},
+		Users:       map[string]*ManagedUser{},
+		HomeFiles:   map[string]map[string]string{},
+		inUse:       systemIDInUse,
+		path:        path,
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read state %q: %s", path, err)
+	}
+	if err = json.Unmarshal(content, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state %q: %s", path, err)
+	}
+	if s.UIDs == nil {
+		s.UIDs = map[string]uint32{}
+	}
+	if s.GIDs == nil {
+		s.GIDs = map[string]uint32{}
+	}
+	if s.ExtraGroups == nil {
+		s.ExtraGroups = map[string][]string{}
+	}
+	if s.Locks == nil {
+		s.Locks = map[string]string{}
+	}
+	if s.Removals == nil {
+		s.Removals = map[string]*Removal{}
+	}
+	if s.Users == nil {
+		s.Users = map[string]*ManagedUser{}
+	}
+	if s.HomeFiles == nil {
+		s.HomeFiles = map[string]map[string]string{}
+	}
+	return s, nil
+}
+
+// Save atomically writes the state to disk
+func (s *State) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, content, 0600)
+}
+
+// UID returns the uid allocated for username, allocating a new one if necessary.
+// Users already present in the system keep their current uid.
+func (s *State) UID(username string) (uint32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if uid, ok := s.UIDs[username]; ok {
+		return uid, nil
+	}
+	if account, err := System.LookupUser(username); err == nil {
+		s.UIDs[username] = account.UID
+		return account.UID, nil
+	}
+	uid, err := s.allocate(username)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate uid for user %q: %s", username, err)
+	}
+	s.UIDs[username] = uid
+	return uid, nil
+}
+
+// RetireUID keeps an username uid allocated under a retired name, so the
+// next user with the same username gets a new uid
+func (s *State) RetireUID(username, suffix string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if uid, ok := s.UIDs[username]; ok {
+		s.UIDs[username+"#"+suffix] = uid
+		delete(s.UIDs, username)
+	}
+}
+
+// GID returns the gid allocated for a group name, allocating a new one if necessary.
+// Groups already present in the system keep their current gid.
+func (s *State) GID(name string) (uint32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if gid, ok := s.GIDs[name]; ok {
+		return gid, nil
+	}
+	if sysGroup, err := System.LookupGroup(name); err == nil {
+		s.GIDs[name] = sysGroup.GID
+		return sysGroup.GID, nil
+	}
+	gid, err := s.allocate(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate gid for group %q: %s", name, err)
+	}
+	s.GIDs[name] = gid
+	return gid, nil
+}
+
+// allocate finds a free id, starting from the name hash and probing forward on collisions
+func (s *State) allocate(name string) (uint32, error) {
+	taken := map[uint32]bool{}
+	for _, id := range s.UIDs {
+		taken[id] = true
+	}
+	for _, id := range s.GIDs {
+		taken[id] = true
+	}
+	start := uint32(uidFromString(name))
+	span := uint32(maxID - minID + 1)
+	for i := uint32(0); i < span; i++ {
+		id := minID + (start-minID+i)%span
+		if taken[id] || s.inUse(id) {
+			continue
+		}
+		return id, nil
+	}
+	return 0, fmt.Errorf("no free ids left")
+}
+
+// systemIDInUse checks whether the id is used by a system user or group
+func systemIDInUse(id uint32) bool {
+	return System.IDInUse(id)
+}
+
+// writeFileAtomic writes content to a temporary file and renames it over filename
+func writeFileAtomic(filename string, content []byte, mode os.FileMode) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err = fp.Write(content); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Chmod(mode); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), filename)
+}
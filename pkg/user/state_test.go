@@ -0,0 +1,88 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateAllocationIsStableAndPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.inUse = func(uint32) bool { return false }
+	uid, err := state.UID("bastrd-test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != uint32(uidFromString("bastrd-test-user")) {
+		t.Errorf("expected uid %d derived from username, got %d", uidFromString("bastrd-test-user"), uid)
+	}
+	if err = state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	state, err = LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.inUse = func(uint32) bool { return false }
+	again, err := state.UID("bastrd-test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != uid {
+		t.Errorf("uid changed across state loads, got %d expected %d", again, uid)
+	}
+}
+
+func TestStateAllocationAvoidsCollisions(t *testing.T) {
+	state := &State{
+		UIDs:  map[string]uint32{"bastrd-test-user": uint32(uidFromString("bastrd-test-group"))},
+		GIDs:  map[string]uint32{},
+		inUse: func(id uint32) bool { return id == uint32(uidFromString("bastrd-test-group"))+1 },
+	}
+	gid, err := state.GID("bastrd-test-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := uint32(uidFromString("bastrd-test-group")) + 2
+	if gid != expected {
+		t.Errorf("expected colliding ids to be skipped, got gid %d expected %d", gid, expected)
+	}
+}
+
+func TestStateRetireUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state, err := LoadState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.inUse = func(uint32) bool { return false }
+	uid, err := state.UID("bastrd-test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.RetireUID("bastrd-test-user", "AIDAOLD")
+	again, err := state.UID("bastrd-test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == uid {
+		t.Errorf("expected a retired uid not to be reused, got %d again", uid)
+	}
+	if state.UIDs["bastrd-test-user#AIDAOLD"] != uid {
+		t.Errorf("expected retired uid to stay allocated, got %#v", state.UIDs)
+	}
+}
@@ -0,0 +1,97 @@
+package user
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ShellsPath is the list of valid login shells
+const ShellsPath = "/etc/shells"
+
+// LoginShells are the shells accepted on the shell tag, usually /etc/shells entries
+var LoginShells = []string{}
+
+// Directory user tags controlling per user attributes
+const (
+	// TagExpires holds the account expiration date, e.g. "2026-12-31"
+	TagExpires = "bastrd:expires"
+	// TagGroups holds space separated extra system groups for the user, e.g. "docker wheel", sync only grants allowed ones
+	TagGroups = "bastrd:groups"
+	// TagSandbox set to false gives the user a host shell instead of the toolbox
+	TagSandbox = "bastrd:sandbox"
+	// TagShell holds an explicit login shell path listed on LoginShells, it takes precedence over TagSandbox
+	TagShell = "bastrd:shell"
+	// TagUsername holds an explicit system username, it takes precedence over the mapped AWS IAM username
+	TagUsername = "bastrd:username"
+)
+
+// LoginShell returns the user login shell, honoring the shell and sandbox
+// tags over the default sandboxing setting
+func (u *User) LoginShell(sandboxed bool) string {
+	if shell, ok := u.Tags[TagShell]; ok {
+		if stringIn(shell, LoginShells) {
+			return shell
+		}
+		log.Printf("Ignoring user %q invalid %s tag %q, must be listed on %s", u.Username, TagShell, shell, ShellsPath)
+	}
+	if sandbox, ok := u.Tags[TagSandbox]; ok {
+		switch strings.ToLower(sandbox) {
+		case "false", "no", "off":
+			sandboxed = false
+		case "true", "yes", "on":
+			sandboxed = true
+		default:
+			log.Printf("Ignoring user %q invalid %s tag %q", u.Username, TagSandbox, sandbox)
+		}
+	}
+	return DefaultShell(sandboxed)
+}
+
+// TagGroups returns the extra system group names from the groups tag.
+// AWS IAM tag values can't hold commas, so names are separated by spaces,
+// commas are accepted for other directories.
+func (u *User) TagGroups() []string {
+	return strings.FieldsFunc(u.Tags[TagGroups], func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// TagExpiration returns the account expiration date from the expires tag,
+// the zero time if the tag isn't set or is invalid
+func (u *User) TagExpiration() time.Time {
+	value, ok := u.Tags[TagExpires]
+	if !ok || value == "" {
+		return time.Time{}
+	}
+	expires, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		log.Printf("Ignoring user %q invalid %s tag %q, must be a date like 2006-01-02", u.Username, TagExpires, value)
+		return time.Time{}
+	}
+	return expires
+}
+
+// ReadShells reads the login shells of a shells file, an unexistent file results in no shells
+func ReadShells(path string) ([]string, error) {
+	shells := []string{}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return shells, nil
+		}
+		return shells, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		shells = append(shells, line)
+	}
+	return shells, scanner.Err()
+}
@@ -0,0 +1,80 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserLoginShell(t *testing.T) {
+	defer func(shells []string) { LoginShells = shells }(LoginShells)
+	LoginShells = []string{"/bin/bash", "/bin/zsh"}
+	cases := []struct {
+		tags      map[string]string
+		sandboxed bool
+		expected  string
+	}{
+		{nil, true, ToolboxShell},
+		{nil, false, HostShell},
+		{map[string]string{TagSandbox: "false"}, true, HostShell},
+		{map[string]string{TagSandbox: "true"}, false, ToolboxShell},
+		{map[string]string{TagSandbox: "maybe"}, true, ToolboxShell},
+		{map[string]string{TagShell: "/bin/zsh", TagSandbox: "true"}, true, "/bin/zsh"},
+		{map[string]string{TagShell: "zsh"}, true, ToolboxShell},
+		{map[string]string{TagShell: "/tmp/evil"}, false, HostShell},
+	}
+	for _, c := range cases {
+		u := &User{Username: "rochacon", Tags: c.tags}
+		if shell := u.LoginShell(c.sandboxed); shell != c.expected {
+			t.Errorf("unexpected shell for tags %v sandboxed %v: got %q expected %q", c.tags, c.sandboxed, shell, c.expected)
+		}
+	}
+}
+
+func TestReadShells(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bastrd-shells")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shells")
+	if err = ioutil.WriteFile(path, []byte("# /etc/shells: valid login shells\n/bin/sh\n\n/bin/bash\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shells, err := ReadShells(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shells) != 2 || shells[0] != "/bin/sh" || shells[1] != "/bin/bash" {
+		t.Errorf("unexpected shells: %#v", shells)
+	}
+	if shells, err = ReadShells(filepath.Join(dir, "missing")); err != nil || len(shells) != 0 {
+		t.Errorf("expected no shells for a missing file, got %#v: %v", shells, err)
+	}
+}
+
+func TestUserTagGroups(t *testing.T) {
+	u := &User{Username: "rochacon", Tags: map[string]string{TagGroups: "docker  wheel,adm"}}
+	groups := u.TagGroups()
+	if len(groups) != 3 || groups[0] != "docker" || groups[1] != "wheel" || groups[2] != "adm" {
+		t.Errorf("unexpected tag groups: %#v", groups)
+	}
+	if groups = (&User{Username: "rochacon"}).TagGroups(); len(groups) != 0 {
+		t.Errorf("expected no tag groups, got %#v", groups)
+	}
+}
+
+func TestUserTagExpiration(t *testing.T) {
+	u := &User{Username: "rochacon", Tags: map[string]string{TagExpires: "2026-12-31"}}
+	if expires := u.TagExpiration(); !expires.Equal(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected expiration %s", expires)
+	}
+	for _, value := range []string{"", "31/12/2026", "never"} {
+		u.Tags[TagExpires] = value
+		if expires := u.TagExpiration(); !expires.IsZero() {
+			t.Errorf("expected no expiration for %q, got %s", value, expires)
+		}
+	}
+}
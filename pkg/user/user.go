@@ -5,21 +5,81 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
-	"os/exec"
 	osuser "os/user"
 	"path/filepath"
-	"strings"
+	"time"
+)
+
+// Login shells
+const (
+	HostShell    = "/bin/bash"
+	ToolboxShell = "/opt/bin/bastrd-toolbox"
 )
 
 // User represents a mirrored user between AWS IAM and the local system
 type User struct {
-	Groups   []*Group
-	Username string
+	// Expires is the account expiration date, zero if it never expires
+	Expires time.Time `json:"-"`
+	Groups  []*Group  `json:"groups"`
+	// IAMUserID is the AWS IAM user unique id, if known
+	IAMUserID string `json:"iam_user_id,omitempty"`
+	// IAMUsername is the AWS IAM username the system Username maps from
+	IAMUsername string `json:"iam_username,omitempty"`
+	// Locked is why the account is locked, empty if it isn't
+	Locked   string            `json:"locked,omitempty"`
+	Shell    string            `json:"shell,omitempty"`
+	Tags     map[string]string `json:"-"`
+	UID      uint32            `json:"uid,omitempty"`
+	Username string            `json:"username"`
+}
+
+// DefaultShell returns the login shell for sandboxed and non-sandboxed users
+func DefaultShell(sandboxed bool) string {
+	if sandboxed {
+		return ToolboxShell
+	}
+	return HostShell
 }
 
 // Ensure ensure a user is correctly configured on the system
-func (u *User) Ensure(sandboxed bool, additionalGroups []string) error {
-	return ensureUser(u.Username, sandboxed, additionalGroups)
+func (u *User) Ensure(additionalGroups []string) error {
+	shell := u.Shell
+	if shell == "" {
+		shell = ToolboxShell
+	}
+	iamUsername := u.IAMUsername
+	if iamUsername == "" {
+		iamUsername = u.Username
+	}
+	return ensureUser(u.Username, iamUsername, u.UID, shell, additionalGroups)
+}
+
+// AppendSystemGroups appends the given system groups the user is a member of to its groups
+func (u *User) AppendSystemGroups(names ...string) error {
+	for _, name := range names {
+		sysGroup, err := System.LookupGroup(name)
+		if err != nil {
+			if _, ok := err.(osuser.UnknownGroupError); ok {
+				continue
+			}
+			return err
+		}
+		if stringIn(u.Username, sysGroup.Members) && !groupIn(&Group{Name: name}, u.Groups) {
+			u.Groups = append(u.Groups, &Group{GID: sysGroup.GID, Name: name})
+		}
+	}
+	return nil
+}
+
+// GroupsDiff returns the groups of self that the other user is not a member of
+func (u *User) GroupsDiff(other *User) []*Group {
+	diff := []*Group{}
+	for _, g := range u.Groups {
+		if !groupIn(g, other.Groups) {
+			diff = append(diff, g)
+		}
+	}
+	return diff
 }
 
 // HomeDir returns the user's home directory
@@ -27,62 +87,77 @@ func (u User) HomeDir() string {
 	return filepath.Join("/home", u.Username)
 }
 
+// UpdateShell sets the user login shell on the system
+func (u *User) UpdateShell() error {
+	err := System.SetShell(u.Username, u.Shell)
+	if err != nil {
+		return fmt.Errorf("failed to update user %q shell to %q: %s", u.Username, u.Shell, err)
+	}
+	return nil
+}
+
 // Remove removes an user from the system
 func (u *User) Remove() error {
-	return exec.Command("/usr/sbin/userdel", "--remove", u.Username).Run()
+	if err := ensureManaged(u.Username); err != nil {
+		return err
+	}
+	return System.DeleteUser(u.Username)
 }
 
-// Uid returns the user unique id
-func (u User) Uid() uint16 {
-	return uidFromString(u.Username)
+// Uid returns the user unique id, either the allocated UID, the one
+// found on the system or the one recorded on bastrd state
+func (u User) Uid() (uint32, error) {
+	if u.UID != 0 {
+		return u.UID, nil
+	}
+	if account, err := System.LookupUser(u.Username); err == nil {
+		return account.UID, nil
+	}
+	state, err := LoadState(DefaultStatePath)
+	if err != nil {
+		return 0, err
+	}
+	uid, ok := state.UIDs[u.Username]
+	if !ok {
+		return 0, fmt.Errorf("no uid allocated for user %q", u.Username)
+	}
+	return uid, nil
 }
 
 // ensureUser add an user in the system idempotently
-func ensureUser(username string, sandboxed bool, additionalGroups []string) error {
+func ensureUser(username, iamUsername string, uid uint32, shell string, additionalGroups []string) error {
 	if userExists(username) {
 		return nil
 	}
-	if err := userAdd(username, sandboxed, additionalGroups); err != nil {
+	if uid == 0 {
+		return fmt.Errorf("refusing to create user %q without an allocated uid", username)
+	}
+	if err := userAdd(username, iamUsername, uid, shell, additionalGroups); err != nil {
 		return fmt.Errorf("failed to create user: %q", err)
 	}
 	log.Printf("Created user %q", username)
 	return nil
 }
 
-// userAdd adds a user to the system with toolbox as the default shell
-func userAdd(username string, sandboxed bool, additionalGroups []string) error {
-	shell := "/opt/bin/bastrd-toolbox"
-	if !sandboxed {
-		shell = "/bin/bash"
-	}
-	uid := fmt.Sprintf("%d", uidFromString(username))
-	cmd := exec.Command(
-		"/usr/sbin/useradd",
-		"-m",
-		"-u", uid,
-		"-U",
-		"-G", strings.Join(additionalGroups, ","),
-		"-p", "*", // disable password
-		"-s", shell,
-		"-c", "bastrd managed user",
-		username,
-	)
-	err := cmd.Run()
-	if err != nil {
-		out, _ := cmd.Output()
-		log.Printf("call to useradd %q failed: %q %q", username, err, out)
-		return fmt.Errorf("call to useradd %q failed: %q", username, err)
-	}
-	return nil
+// userAdd adds a user to the system with the given login shell, recording its AWS IAM username
+func userAdd(username, iamUsername string, uid uint32, shell string, additionalGroups []string) error {
+	return System.AddUser(&Account{
+		Gecos:  managedAccountGecos(iamUsername),
+		Groups: additionalGroups,
+		Home:   User{Username: username}.HomeDir(),
+		Name:   username,
+		Shell:  shell,
+		UID:    uid,
+	})
 }
 
 // userExists checks if the user already exists in the system
 func userExists(username string) bool {
-	_, err := osuser.Lookup(username)
+	_, err := System.LookupUser(username)
 	return err == nil
 }
 
-// uidFromString Converts an string into an uid
+// uidFromString Converts an string into an uid, used as the starting point of id allocation
 func uidFromString(awsID string) uint16 {
 	sha := sha1.Sum([]byte(awsID))
 	last2 := sha[len(sha)-2:]
@@ -0,0 +1,97 @@
+package user
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// managedGecos marks the system accounts created by bastrd
+	managedGecos = "bastrd managed user"
+	// maxUsernameLength is the longest system username useradd accepts
+	maxUsernameLength = 32
+)
+
+var (
+	// invalidUsernameChars matches AWS IAM username characters system usernames don't allow
+	invalidUsernameChars = regexp.MustCompile(`[^a-z0-9_.-]`)
+	// validUsername matches portable system usernames
+	validUsername = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*$`)
+)
+
+// SystemUsername maps an AWS IAM username into a system username. The
+// TagUsername tag takes precedence, otherwise the AWS IAM username is
+// lowercased and the characters not allowed on system usernames, e.g. "@",
+// "+", "=" and ",", are replaced by "_".
+func SystemUsername(iamUsername string, tags map[string]string) (string, error) {
+	if username, ok := tags[TagUsername]; ok {
+		if !ValidUsername(username) {
+			return "", fmt.Errorf("invalid %s tag %q", TagUsername, username)
+		}
+		return username, nil
+	}
+	username := invalidUsernameChars.ReplaceAllString(strings.ToLower(iamUsername), "_")
+	if !ValidUsername(username) {
+		return "", fmt.Errorf("AWS IAM username %q maps to the invalid system username %q, set the %s tag", iamUsername, username, TagUsername)
+	}
+	return username, nil
+}
+
+// ValidUsername checks wether an username is a valid system username
+func ValidUsername(username string) bool {
+	return len(username) <= maxUsernameLength && validUsername.MatchString(username)
+}
+
+// IAMUsername maps a system username back to its AWS IAM username, recorded
+// on the account GECOS by sync. Accounts without it map to the same name.
+func IAMUsername(username string) string {
+	account, err := System.LookupUser(username)
+	if err != nil {
+		return username
+	}
+	if iamUsername, ok := parseGecos(account.Gecos); ok {
+		return iamUsername
+	}
+	return username
+}
+
+// accountOwner returns the AWS IAM username owning an existing managed
+// account, accounts created before it was recorded on the GECOS belong to
+// the AWS IAM user of the same name
+func accountOwner(username string) (string, bool) {
+	account, err := System.LookupUser(username)
+	if err != nil || strings.SplitN(account.Gecos, ",", 2)[0] != managedGecos {
+		return "", false
+	}
+	if iamUsername, ok := parseGecos(account.Gecos); ok {
+		return iamUsername, true
+	}
+	return username, true
+}
+
+// OwnedBy checks wether an account isn't reserved and was created by sync
+// for the AWS IAM user
+func OwnedBy(username, iamUsername string) bool {
+	if Reserved(username) {
+		return false
+	}
+	owner, ok := accountOwner(username)
+	return ok && owner == iamUsername
+}
+
+// managedAccountGecos returns the GECOS of a managed account. The AWS IAM
+// username goes on the "other" field, which users can't change with chfn.
+func managedAccountGecos(iamUsername string) string {
+	return fmt.Sprintf("%s,,,,iam=%s", managedGecos, iamUsername)
+}
+
+// parseGecos returns the AWS IAM username recorded on a managed account GECOS
+func parseGecos(gecos string) (string, bool) {
+	fields := strings.SplitN(gecos, ",", 5)
+	if len(fields) != 5 || fields[0] != managedGecos || !strings.HasPrefix(fields[4], "iam=") {
+		return "", false
+	}
+	iamUsername := strings.TrimPrefix(fields[4], "iam=")
+	return iamUsername, iamUsername != ""
+}
@@ -0,0 +1,145 @@
+package user
+
+import (
+	"testing"
+)
+
+func TestSystemUsername(t *testing.T) {
+	tests := []struct {
+		iamUsername string
+		tags        map[string]string
+		expected    string
+	}{
+		{"rochacon", nil, "rochacon"},
+		{"Rodrigo.Chacon", nil, "rodrigo.chacon"},
+		{"rodrigo+ops@example.com", nil, "rodrigo_ops_example.com"},
+		{"a=b,c", nil, "a_b_c"},
+		{"Rodrigo.Chacon", map[string]string{TagUsername: "rochacon"}, "rochacon"},
+	}
+	for _, test := range tests {
+		username, err := SystemUsername(test.iamUsername, test.tags)
+		if err != nil {
+			t.Errorf("failed to map %q: %s", test.iamUsername, err)
+			continue
+		}
+		if username != test.expected {
+			t.Errorf("expected %q to map to %q, got %q", test.iamUsername, test.expected, username)
+		}
+	}
+	invalid := []struct {
+		iamUsername string
+		tags        map[string]string
+	}{
+		{"1password", nil},
+		{"-dash", nil},
+		{"a-very-long-aws-iam-username-over-32-chars", nil},
+		{"rochacon", map[string]string{TagUsername: "Ro:Chacon"}},
+	}
+	for _, test := range invalid {
+		if username, err := SystemUsername(test.iamUsername, test.tags); err == nil {
+			t.Errorf("expected %q to be unmappable, got %q", test.iamUsername, username)
+		}
+	}
+}
+
+func TestIAMUsernameFromGecos(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	u := &User{IAMUsername: "Rodrigo.Chacon@example.com", UID: 2000, Username: "rodrigo.chacon_example.com"}
+	if err := u.Ensure(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddUser(&Account{Gecos: managedGecos, Home: "/home/legacy", Name: "legacy", UID: 2001}); err != nil {
+		t.Fatal(err)
+	}
+	for username, expected := range map[string]string{
+		"rodrigo.chacon_example.com": "Rodrigo.Chacon@example.com",
+		"legacy":                     "legacy",
+		"unknown":                    "unknown",
+	} {
+		if iamUsername := IAMUsername(username); iamUsername != expected {
+			t.Errorf("expected %q to map back to %q, got %q", username, expected, iamUsername)
+		}
+	}
+}
+
+func TestOwnedBy(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	u := &User{IAMUsername: "Alice", UID: 2000, Username: "alice"}
+	if err := u.Ensure(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddUser(&Account{Gecos: managedGecos, Home: "/home/legacy", Name: "legacy", UID: 2001}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddUser(&Account{Home: "/home/ubuntu", Name: "ubuntu", UID: 2002}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username    string
+		iamUsername string
+		expected    bool
+	}{
+		{"alice", "Alice", true},
+		{"alice", "Mallory", false},
+		{"legacy", "legacy", true},
+		{"legacy", "Mallory", false},
+		{"ubuntu", "ubuntu", false},
+		{"root", "root", false},
+		{"unknown", "unknown", false},
+	}
+	for _, test := range tests {
+		if owned := OwnedBy(test.username, test.iamUsername); owned != test.expected {
+			t.Errorf("expected %q owned by %q to be %t", test.username, test.iamUsername, test.expected)
+		}
+	}
+}
+
+func TestFromDirectorySkipsUnmappableUsers(t *testing.T) {
+	dir := &FileDirectory{
+		Groups: map[string][]string{
+			"devs": []string{"Rochacon", "rochacon", "1password", "Someone"},
+		},
+		Users: map[string]*FileDirectoryUser{
+			"Someone": &FileDirectoryUser{Tags: map[string]string{TagUsername: "root"}},
+		},
+	}
+	users, err := FromDirectory(dir, &Group{Name: "devs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "rochacon" || users[0].IAMUsername != "Rochacon" {
+		t.Errorf("unexpected users %#v", users)
+	}
+}
+
+func TestFromDirectorySkipsUsernameTakeover(t *testing.T) {
+	f, cleanup := newFilesRoot(t)
+	defer cleanup()
+	defer func(b Backend) { System = b }(System)
+	System = f
+	owner := &User{IAMUsername: "Alice", UID: 2000, Username: "alice"}
+	if err := owner.Ensure(nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := &FileDirectory{
+		Groups: map[string][]string{
+			"devs": []string{"Mallory", "Alice"},
+		},
+		Users: map[string]*FileDirectoryUser{
+			"Mallory": &FileDirectoryUser{Tags: map[string]string{TagUsername: "alice"}},
+		},
+	}
+	users, err := FromDirectory(dir, &Group{Name: "devs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "alice" || users[0].IAMUsername != "Alice" {
+		t.Errorf("unexpected users %#v", users)
+	}
+}
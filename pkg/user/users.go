@@ -3,12 +3,7 @@ package user
 import (
 	"fmt"
 	"log"
-	"os/exec"
 	osuser "os/user"
-	"strings"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/iam"
 )
 
 // Users holds a collection of User
@@ -25,33 +20,218 @@ func (self Users) Diff(users Users) Users {
 	return diff
 }
 
+// Get returns the User with the given username, or nil if it is not in the collection
+func (self Users) Get(username string) *User {
+	for _, u := range self {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
 // FromIAMGroups returns a single Users collection for the given AWS IAM groups
 func FromIAMGroups(svc IAM, groups ...*Group) (Users, error) {
-	users := Users{}
-	usersMap := map[string]*User{}
-	for _, group := range groups {
-		log.Printf("Retrieving AWS IAM group %q", group.Name)
-		iamGroup, err := svc.GetGroup(&iam.GetGroupInput{
-			GroupName: aws.String(group.Name),
-		})
+	return FromDirectory(NewIAMDirectory(svc), groups...)
+}
+
+// FromDirectory returns a single Users collection for the given Directory groups.
+// Users whose AWS IAM username can't be mapped to a system username, or
+// that map to an username already taken, either by another AWS IAM user or
+// by the managed account of another one, are reported and skipped.
+func FromDirectory(dir Directory, groups ...*Group) (Users, error) {
+	return FromDirectorySelector(dir, nil, groups...)
+}
+
+// FromDirectorySelector returns a single Users collection for the given
+// Directory groups members and the users chosen by the selector, which are
+// members of the selector group
+func FromDirectorySelector(dir Directory, selector *Selector, groups ...*Group) (Users, error) {
+	b := newDirectoryUsers(dir)
+	members := make([][]*Identity, len(groups))
+	err := parallel(directoryWorkers(dir), len(groups), func(i int) error {
+		log.Printf("Retrieving group %q", groups[i].Name)
+		var err error
+		members[i], err = dir.GroupMembers(groups[i].Name)
+		return err
+	})
+	if err != nil {
+		return b.users, err
+	}
+	selected := []*Identity{}
+	if !selector.Empty() {
+		log.Printf("Retrieving users under path %q", selector.pathPrefix())
+		selected, err = dir.ListUsers(selector.pathPrefix())
 		if err != nil {
-			return users, fmt.Errorf("Error retrieving group %q info: %s", group.Name, err)
+			return b.users, err
 		}
-		for _, iamUser := range iamGroup.Users {
-			if *iamUser.UserName == "root" || *iamUser.UserName == "core" || *iamUser.UserName == "ec2-user" {
-				log.Printf("Found reserved username %q in group %q, skipping it.", *iamUser.UserName, *iamGroup.Group.GroupName)
-				continue
+	}
+	identities := selected
+	for _, m := range members {
+		identities = append(identities, m...)
+	}
+	if err = b.fetchTags(identities); err != nil {
+		return b.users, err
+	}
+	for i, group := range groups {
+		for _, member := range members[i] {
+			usr, err := b.get(member)
+			if err != nil {
+				return b.users, err
 			}
-			usr, ok := usersMap[*iamUser.UserName]
-			if !ok {
-				usr = &User{Username: *iamUser.UserName}
-				usr.Groups = []*Group{group}
-				users = append(users, usr)
+			if usr != nil {
+				b.add(usr, group)
 			}
-			usr.Groups = append(usr.Groups, group)
 		}
 	}
-	return users, nil
+	for _, identity := range selected {
+		if err = b.selectUser(selector, identity); err != nil {
+			return b.users, err
+		}
+	}
+	return b.users, nil
+}
+
+// FromDirectoryUser returns a Users collection holding the given AWS IAM
+// user if it is a member of any of the Directory groups or chosen by the
+// selector, or an empty one otherwise
+func FromDirectoryUser(dir Directory, iamUsername string, selector *Selector, groups ...*Group) (Users, error) {
+	b := newDirectoryUsers(dir)
+	identity, err := dir.User(iamUsername)
+	if err != nil || identity == nil {
+		return b.users, err
+	}
+	names, err := dir.UserGroups(iamUsername)
+	if err != nil {
+		return b.users, err
+	}
+	for _, group := range groups {
+		if !stringIn(group.Name, names) {
+			continue
+		}
+		usr, err := b.get(identity)
+		if err != nil || usr == nil {
+			return b.users, err
+		}
+		b.add(usr, group)
+	}
+	if selector.Empty() {
+		return b.users, nil
+	}
+	return b.users, b.selectUser(selector, identity)
+}
+
+// directoryUsers builds a Users collection out of Directory users
+type directoryUsers struct {
+	dir Directory
+	// candidates maps AWS IAM usernames to users, including the ones without groups
+	candidates map[string]*User
+	skipped    map[string]bool
+	// tags maps AWS IAM usernames to their prefetched tags
+	tags  map[string]map[string]string
+	users Users
+}
+
+func newDirectoryUsers(dir Directory) *directoryUsers {
+	return &directoryUsers{
+		dir:        dir,
+		candidates: map[string]*User{},
+		skipped:    map[string]bool{},
+		tags:       map[string]map[string]string{},
+		users:      Users{},
+	}
+}
+
+// fetchTags retrieves the tags of the identities concurrently, ahead of get
+func (b *directoryUsers) fetchTags(identities []*Identity) error {
+	usernames := []string{}
+	seen := map[string]bool{}
+	for _, identity := range identities {
+		if _, ok := b.tags[identity.Username]; !ok && !seen[identity.Username] {
+			seen[identity.Username] = true
+			usernames = append(usernames, identity.Username)
+		}
+	}
+	tags := make([]map[string]string, len(usernames))
+	err := parallel(directoryWorkers(b.dir), len(usernames), func(i int) error {
+		var err error
+		tags[i], err = b.dir.UserTags(usernames[i])
+		if err != nil {
+			return fmt.Errorf("Error retrieving user %q tags: %s", usernames[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, username := range usernames {
+		b.tags[username] = tags[i]
+	}
+	return nil
+}
+
+// get returns the User of a Directory identity with its tags, or nil if it
+// can't be mapped to a system username
+func (b *directoryUsers) get(identity *Identity) (*User, error) {
+	iamUsername := identity.Username
+	if b.skipped[iamUsername] {
+		return nil, nil
+	}
+	if usr, ok := b.candidates[iamUsername]; ok {
+		return usr, nil
+	}
+	if err := b.fetchTags([]*Identity{identity}); err != nil {
+		return nil, err
+	}
+	tags := b.tags[iamUsername]
+	username, err := SystemUsername(iamUsername, tags)
+	if err != nil {
+		log.Printf("Skipping AWS IAM user %q: %s", iamUsername, err)
+		b.skipped[iamUsername] = true
+		return nil, nil
+	}
+	if Reserved(username) {
+		log.Printf("Found reserved username %q, skipping it.", username)
+		b.skipped[iamUsername] = true
+		return nil, nil
+	}
+	if owner, ok := accountOwner(username); ok && owner != iamUsername {
+		log.Printf("Skipping AWS IAM user %q: system username %q belongs to AWS IAM user %q", iamUsername, username, owner)
+		b.skipped[iamUsername] = true
+		return nil, nil
+	}
+	usr := &User{IAMUserID: identity.ID, IAMUsername: iamUsername, Tags: tags, Username: username}
+	b.candidates[iamUsername] = usr
+	return usr, nil
+}
+
+// add makes an user a member of group, adding it to the collection unless
+// its system username is already taken
+func (b *directoryUsers) add(usr *User, group *Group) {
+	if other := b.users.Get(usr.Username); other != nil && other != usr {
+		log.Printf("Skipping AWS IAM user %q: system username %q is taken by AWS IAM user %q", usr.IAMUsername, usr.Username, other.IAMUsername)
+		b.skipped[usr.IAMUsername] = true
+		delete(b.candidates, usr.IAMUsername)
+		return
+	}
+	if len(usr.Groups) == 0 {
+		b.users = append(b.users, usr)
+	}
+	if !groupIn(group, usr.Groups) {
+		usr.Groups = append(usr.Groups, group)
+	}
+}
+
+// selectUser adds an user to the selector group if it matches the selector
+func (b *directoryUsers) selectUser(selector *Selector, identity *Identity) error {
+	usr, err := b.get(identity)
+	if err != nil || usr == nil {
+		return err
+	}
+	if selector.Matches(identity.Path, usr.Tags) {
+		b.add(usr, selector.Group)
+	}
+	return nil
 }
 
 // FromSystemGroups returns a single Users collection for the given system groups
@@ -59,31 +239,43 @@ func FromSystemGroups(groups ...*Group) (Users, error) {
 	users := Users{}
 	usersMap := map[string]*User{}
 	for _, group := range groups {
-		_, err := osuser.LookupGroup(group.Name)
+		sysGroup, err := System.LookupGroup(group.Name)
 		if err != nil {
 			if _, ok := err.(osuser.UnknownGroupError); !ok {
 				return users, err
 			}
 			continue
 		}
-		groupLine, err := exec.Command("getent", "group", group.Name).Output()
-		if err != nil {
-			return users, fmt.Errorf("failed to retrieve group details: %s", err)
-		}
-		parts := strings.Split(strings.TrimSpace(string(groupLine)), ":")
-		usersPart := strings.Split(parts[3], ",")
-		for _, username := range usersPart {
+		for _, username := range sysGroup.Members {
 			if username == "" {
 				continue
 			}
-			if username == "root" || username == "core" || username == "ec2-user" {
+			if Reserved(username) {
 				log.Printf("Found reserved username %q in group %q, skipping it.", username, group.Name)
 				continue
 			}
 			usr, ok := usersMap[username]
 			if !ok {
-				usr = &User{Username: username}
-				usr.Groups = []*Group{group}
+				usr = &User{IAMUsername: username, Username: username}
+				account, err := System.LookupUser(username)
+				if err != nil {
+					log.Printf("Failed to retrieve user %q details: %s", username, err)
+				} else {
+					usr.Shell = account.Shell
+					if iamUsername, ok := parseGecos(account.Gecos); ok {
+						usr.IAMUsername = iamUsername
+					}
+				}
+				shadow, err := System.LookupShadow(username)
+				if err != nil {
+					log.Printf("Failed to retrieve user %q lock state: %s", username, err)
+				} else {
+					usr.Expires = shadow.Expires
+					if shadow.Locked {
+						usr.Locked = "locked on the system"
+					}
+				}
+				usersMap[usr.Username] = usr
 				users = append(users, usr)
 			}
 			usr.Groups = append(usr.Groups, group)
@@ -47,3 +47,66 @@ func TestUserIn(t *testing.T) {
 		t.Errorf("user \"nope\" does not exist on collection, wrong match: %#v", users)
 	}
 }
+
+func TestUsersGet(t *testing.T) {
+	users := Users{
+		&User{Username: "rochacon"},
+	}
+	if u := users.Get("rochacon"); u == nil || u.Username != "rochacon" {
+		t.Errorf("failed to get user \"rochacon\" from %#v, got %#v", users, u)
+	}
+	if u := users.Get("nope"); u != nil {
+		t.Errorf("user \"nope\" does not exist on collection, got %#v", u)
+	}
+}
+
+func TestUserGroupsDiff(t *testing.T) {
+	iamUser := &User{
+		Username: "rochacon",
+		Groups:   []*Group{&Group{Name: "bastrd"}, &Group{Name: "admins"}},
+	}
+	sysUser := &User{
+		Username: "rochacon",
+		Groups:   []*Group{&Group{Name: "bastrd"}, &Group{Name: "developers"}},
+	}
+	toAdd := iamUser.GroupsDiff(sysUser)
+	if len(toAdd) != 1 || toAdd[0].Name != "admins" {
+		t.Errorf("expected group \"admins\" to be added, got %#v", toAdd)
+	}
+	toRemove := sysUser.GroupsDiff(iamUser)
+	if len(toRemove) != 1 || toRemove[0].Name != "developers" {
+		t.Errorf("expected group \"developers\" to be removed, got %#v", toRemove)
+	}
+}
+
+func TestFromDirectoryUser(t *testing.T) {
+	dir := &FileDirectory{
+		Groups: map[string][]string{
+			"devs":  []string{"rochacon", "root"},
+			"other": []string{"rochacon", "someone"},
+		},
+		Users: map[string]*FileDirectoryUser{
+			"rochacon": &FileDirectoryUser{Tags: map[string]string{TagShell: "host"}},
+		},
+	}
+	groups := []*Group{&Group{Name: "devs"}}
+	users, err := FromDirectoryUser(dir, "rochacon", nil, groups...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || len(users[0].Groups) != 1 || users[0].Groups[0] != groups[0] {
+		t.Fatalf("unexpected users %#v", users)
+	}
+	if users[0].Tags[TagShell] != "host" {
+		t.Errorf("expected user tags to be loaded, got %#v", users[0].Tags)
+	}
+	for _, username := range []string{"someone", "unknown", "root"} {
+		users, err = FromDirectoryUser(dir, username, nil, groups...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 0 {
+			t.Errorf("expected no users for %q, got %#v", username, users)
+		}
+	}
+}
@@ -57,7 +57,7 @@ AllowGroups ${var.ssh_group_name}
 AllowStreamLocalForwarding no
 AllowTcpForwarding no
 AuthenticationMethods publickey,keyboard-interactive:pam
-AuthorizedKeysCommand /opt/bin/bastrd authorized-keys --allowed-group=${var.ssh_group_name} %u
+AuthorizedKeysCommand /opt/bin/bastrd authorized-keys --allowed-group=${var.ssh_group_name} %u %f %t
 AuthorizedKeysCommandUser nobody
 ChallengeResponseAuthentication yes
 ClientAliveInterval 30
@@ -115,7 +115,8 @@ After=syslog.target network.target auditd.service
 Restart=always
 RestartSec=10
 Environment=AWS_DEFAULT_REGION=${var.region}
-ExecStart=/opt/bin/bastrd sync --interval=1m --group=${var.ssh_group_name}
+ExecReload=/bin/kill -HUP $MAINPID
+ExecStart=/opt/bin/bastrd sync --interval=1m --group=${var.ssh_group_name} --sudo-group=${var.ssh_group_name}:ALL
 
 [Install]
 WantedBy=multi-user.target
@@ -186,9 +187,8 @@ data "ignition_file" "sudoers" {
 ## See https://github.com/coreos/bugs/issues/365.
 Defaults env_keep += "LESSCHARSET"
 
-## enable root and ${var.ssh_group_name} group
+## enable root, groups are managed by bastrd sync --sudo-group
 root ALL=(ALL) ALL
-%${var.ssh_group_name} ALL=(ALL) ALL
 EOF
 
   }